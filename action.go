@@ -0,0 +1,125 @@
+package rebirth
+
+import (
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+type actionRule struct {
+	pattern *pattern
+	action  string
+	task    string
+}
+
+// actionRules decides the action for changed files by `watch.rules`.
+// The first matched rule is used, and files that don't match any rules are rebuilt.
+type actionRules struct {
+	root  string
+	rules []*actionRule
+}
+
+func newActionRules(cfg *Watch) *actionRules {
+	rules := []*actionRule{}
+	if cfg != nil {
+		for _, rule := range cfg.Rules {
+			if rule.Pattern == "" {
+				continue
+			}
+			rules = append(rules, &actionRule{
+				pattern: newPattern(rule.Pattern),
+				action:  rule.Action,
+				task:    rule.Task,
+			})
+		}
+	}
+	return &actionRules{
+		root:  watchRoot(cfg),
+		rules: rules,
+	}
+}
+
+// validate returns error if `watch.rules` has malformed patterns.
+func (r *actionRules) validate() error {
+	for _, rule := range r.rules {
+		if err := rule.pattern.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether relPath ( relative path from the watch root ) matches any rules.
+func (r *actionRules) match(relPath string) bool {
+	for _, rule := range r.rules {
+		if rule.pattern.match(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *actionRules) find(path string) *actionRule {
+	relPath, err := filepath.Rel(r.root, path)
+	if err != nil {
+		relPath = path
+	}
+	for _, rule := range r.rules {
+		if rule.pattern.match(relPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *actionRules) matchAnyPath(paths []string) bool {
+	for _, path := range paths {
+		if r.find(path) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type actionPlan struct {
+	tasks          []string
+	rebuild        bool
+	restart        bool
+	modulesChanged bool
+}
+
+func (r *actionRules) plan(paths []string) (*actionPlan, error) {
+	plan := &actionPlan{}
+	tasks := map[string]struct{}{}
+	for _, path := range paths {
+		if isModuleFile(path) {
+			plan.rebuild = true
+			plan.modulesChanged = true
+			continue
+		}
+		rule := r.find(path)
+		if rule == nil {
+			plan.rebuild = true
+			continue
+		}
+		switch rule.action {
+		case "", ActionRebuild:
+			plan.rebuild = true
+		case ActionRestart:
+			plan.restart = true
+		case ActionTask:
+			if rule.task == "" {
+				return nil, xerrors.Errorf("task name is not specified for %s", rule.pattern.src)
+			}
+			if _, exists := tasks[rule.task]; !exists {
+				tasks[rule.task] = struct{}{}
+				plan.tasks = append(plan.tasks, rule.task)
+			}
+			plan.rebuild = true
+		case ActionIgnore:
+		default:
+			return nil, xerrors.Errorf("unknown action %s for %s", rule.action, rule.pattern.src)
+		}
+	}
+	return plan, nil
+}
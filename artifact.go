@@ -0,0 +1,312 @@
+package rebirth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultBuildHistory = 5
+	artifactMetaFile    = "build.json"
+	artifactProgramFile = "program"
+)
+
+// artifact is the binary built in one generation.
+type artifact struct {
+	Generation int       `json:"generation"`
+	Main       string    `json:"main"`
+	SourceHash string    `json:"source_hash"`
+	BuiltAt    time.Time `json:"built_at"`
+
+	dir        string
+	sourceHash chan string
+}
+
+func (a *artifact) programPath() string {
+	return filepath.Join(a.dir, artifactProgramFile)
+}
+
+func (a *artifact) String() string {
+	hash := a.SourceHash
+	if hash == "" {
+		return fmt.Sprintf("generation %d ( built at %s )", a.Generation, a.BuiltAt.Format(time.RFC3339))
+	}
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return fmt.Sprintf("generation %d ( built at %s, source %s )", a.Generation, a.BuiltAt.Format(time.RFC3339), hash)
+}
+
+// artifactStore keeps the last `build.history` artifacts under `builds` directory.
+// The current artifact is swapped to the program path atomically.
+type artifactStore struct {
+	dir         string
+	programPath string
+	currentPath string
+	history     int
+}
+
+func newArtifactStore(dir, programPath string, history int) *artifactStore {
+	if history <= 0 {
+		history = defaultBuildHistory
+	}
+	return &artifactStore{
+		dir:         filepath.Join(dir, "builds"),
+		programPath: programPath,
+		currentPath: filepath.Join(dir, "current"),
+		history:     history,
+	}
+}
+
+// generations returns generation numbers in ascending order.
+func (s *artifactStore) generations() ([]int, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("failed to read %s: %w", s.dir, err)
+	}
+	gens := []int{}
+	for _, entry := range entries {
+		gen, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, entry.Name(), artifactMetaFile)); err != nil {
+			// building or discarded.
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// next creates the directory for the next generation.
+// The source hash is computed while building, because walking the whole tree takes time on large projects.
+func (s *artifactStore) next(main string) (*artifact, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("failed to read %s: %w", s.dir, err)
+	}
+	gen := 1
+	for _, entry := range entries {
+		if n, err := strconv.Atoi(entry.Name()); err == nil && n >= gen {
+			gen = n + 1
+		}
+	}
+	a := &artifact{
+		Generation: gen,
+		Main:       main,
+		dir:        filepath.Join(s.dir, strconv.Itoa(gen)),
+		sourceHash: make(chan string, 1),
+	}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, xerrors.Errorf("failed to create %s: %w", a.dir, err)
+	}
+	go func() {
+		a.sourceHash <- sourceHash(cwd)
+	}()
+	return a, nil
+}
+
+// discard removes the artifact of failed build.
+func (s *artifactStore) discard(a *artifact) {
+	os.RemoveAll(a.dir)
+}
+
+// commit records metadata of built artifact, swaps it to the program path and prunes old artifacts.
+// If the source hash is not computed yet, it doesn't wait for it and the metadata is rewritten later.
+func (s *artifactStore) commit(a *artifact) error {
+	a.BuiltAt = time.Now()
+	hashed := false
+	select {
+	case a.SourceHash = <-a.sourceHash:
+		hashed = true
+	default:
+	}
+	if err := a.writeMeta(); err != nil {
+		return xerrors.Errorf("failed to write build metadata: %w", err)
+	}
+	if !hashed {
+		go s.writeSourceHash(*a)
+	}
+	if err := s.swap(a); err != nil {
+		return xerrors.Errorf("failed to swap program: %w", err)
+	}
+	if err := s.prune(); err != nil {
+		return xerrors.Errorf("failed to prune old artifacts: %w", err)
+	}
+	return nil
+}
+
+func (a *artifact) writeMeta() error {
+	meta, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("failed to encode build metadata: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(a.dir, artifactMetaFile), meta, 0644); err != nil {
+		return xerrors.Errorf("failed to write %s: %w", artifactMetaFile, err)
+	}
+	return nil
+}
+
+// writeSourceHash rewrites the metadata with the source hash after it's computed.
+// The artifact is a copy, so it's not shared with the caller of commit.
+func (s *artifactStore) writeSourceHash(a artifact) {
+	a.SourceHash = <-a.sourceHash
+	if _, err := os.Stat(a.dir); err != nil {
+		// already pruned.
+		return
+	}
+	if err := a.writeMeta(); err != nil {
+		log.Printf("%+v", xerrors.Errorf("failed to write source hash of generation %d: %w", a.Generation, err))
+	}
+}
+
+// swap replaces the program by the artifact atomically. The running program is not affected.
+func (s *artifactStore) swap(a *artifact) error {
+	tmpPath := s.programPath + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.Link(a.programPath(), tmpPath); err != nil {
+		if err := copyFile(a.programPath(), tmpPath); err != nil {
+			return xerrors.Errorf("failed to copy %s: %w", a.programPath(), err)
+		}
+	}
+	if err := os.Rename(tmpPath, s.programPath); err != nil {
+		return xerrors.Errorf("failed to rename %s to %s: %w", tmpPath, s.programPath, err)
+	}
+	if err := ioutil.WriteFile(s.currentPath, []byte(strconv.Itoa(a.Generation)), 0644); err != nil {
+		return xerrors.Errorf("failed to write current generation: %w", err)
+	}
+	return nil
+}
+
+func (s *artifactStore) prune() error {
+	gens, err := s.generations()
+	if err != nil {
+		return xerrors.Errorf("failed to get generations: %w", err)
+	}
+	current, _ := s.current()
+	for len(gens) > s.history {
+		gen := gens[0]
+		gens = gens[1:]
+		if gen == current {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, strconv.Itoa(gen))); err != nil {
+			return xerrors.Errorf("failed to remove generation %d: %w", gen, err)
+		}
+	}
+	return nil
+}
+
+func (s *artifactStore) current() (int, error) {
+	file, err := ioutil.ReadFile(s.currentPath)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to read current generation: %w", err)
+	}
+	gen, err := strconv.Atoi(strings.TrimSpace(string(file)))
+	if err != nil {
+		return 0, xerrors.Errorf("failed to parse current generation: %w", err)
+	}
+	return gen, nil
+}
+
+func (s *artifactStore) load(gen int) (*artifact, error) {
+	dir := filepath.Join(s.dir, strconv.Itoa(gen))
+	meta, err := ioutil.ReadFile(filepath.Join(dir, artifactMetaFile))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read metadata of generation %d: %w", gen, err)
+	}
+	var a artifact
+	if err := json.Unmarshal(meta, &a); err != nil {
+		return nil, xerrors.Errorf("failed to decode metadata of generation %d: %w", gen, err)
+	}
+	a.dir = dir
+	return &a, nil
+}
+
+// previous returns the generation before the current one.
+func (s *artifactStore) previous() (int, error) {
+	current, err := s.current()
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get current generation: %w", err)
+	}
+	gens, err := s.generations()
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get generations: %w", err)
+	}
+	for i := len(gens) - 1; i >= 0; i-- {
+		if gens[i] < current {
+			return gens[i], nil
+		}
+	}
+	return 0, xerrors.Errorf("no generation before %d", current)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return xerrors.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return xerrors.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return xerrors.Errorf("failed to copy to %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return xerrors.Errorf("failed to close %s: %w", dst, err)
+	}
+	return nil
+}
+
+// sourceHash returns the hash of go files and module files under root.
+// Hidden directories ( e.g. .git, .rebirth ) are skipped.
+func sourceHash(root string) string {
+	h := sha256.New()
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(name) != ".go" && !isModuleFile(path) {
+			return nil
+		}
+		hash, exists := fileHash(path)
+		if !exists {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			relPath = path
+		}
+		fmt.Fprintf(h, "%s %s\n", filepath.ToSlash(relPath), hash)
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,87 @@
+package rebirth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/fsnotify.v1"
+)
+
+// Change represents a changed file and operations to it during the quiet period.
+type Change struct {
+	Path string
+	Op   fsnotify.Op
+}
+
+// ChangeSet is a set of changed files passed to the callback of Watcher.
+type ChangeSet struct {
+	Changes []*Change
+	// Deduplicated is the number of events dropped because the content is not changed since the last build.
+	Deduplicated int
+	// ChangedAt is the time of the first event.
+	ChangedAt time.Time
+}
+
+func newChangeSet(ops map[string]fsnotify.Op) *ChangeSet {
+	changes := make([]*Change, 0, len(ops))
+	for path, op := range ops {
+		changes = append(changes, &Change{Path: path, Op: op})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return &ChangeSet{Changes: changes}
+}
+
+// Paths returns changed paths in sorted order.
+func (c *ChangeSet) Paths() []string {
+	if c == nil {
+		return nil
+	}
+	paths := make([]string, 0, len(c.Changes))
+	for _, change := range c.Changes {
+		paths = append(paths, change.Path)
+	}
+	return paths
+}
+
+func (c *ChangeSet) String() string {
+	if c == nil {
+		return ""
+	}
+	changes := make([]string, 0, len(c.Changes))
+	for _, change := range c.Changes {
+		changes = append(changes, change.Path+" ("+change.Op.String()+")")
+	}
+	return strings.Join(changes, ", ")
+}
+
+const (
+	changedFilesEnv     = "REBIRTH_CHANGED_FILES"
+	changedFilesPathEnv = "REBIRTH_CHANGED_FILES_PATH"
+)
+
+// env returns environment variables for hook commands.
+// REBIRTH_CHANGED_FILES has space separated paths, and REBIRTH_CHANGED_FILES_PATH is the file written newline separated paths.
+func (c *ChangeSet) env() ([]string, error) {
+	paths := c.Paths()
+	content := strings.Join(paths, "\n")
+	if len(paths) > 0 {
+		content += "\n"
+	}
+	if err := os.MkdirAll(filepath.Dir(changedFilesPath), 0755); err != nil {
+		return nil, xerrors.Errorf("failed to create directory for %s: %w", changedFilesPath, err)
+	}
+	if err := ioutil.WriteFile(changedFilesPath, []byte(content), 0644); err != nil {
+		return nil, xerrors.Errorf("failed to write changed files to %s: %w", changedFilesPath, err)
+	}
+	return []string{
+		changedFilesEnv + "=" + strings.Join(paths, " "),
+		changedFilesPathEnv + "=" + changedFilesPath,
+	}, nil
+}
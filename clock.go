@@ -0,0 +1,19 @@
+package rebirth
+
+import "time"
+
+// clock abstracts time for Watcher to replace it by fake clock in unit tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -16,11 +18,12 @@ import (
 )
 
 type Option struct {
-	Watch WatchCommand `description:"" command:"watch" hidden:"true"`
-	Init  InitCommand  `description:"create rebirth.yml for configuration" command:"init"`
-	Run   RunCommand   `description:"execute 'go run'   command"           command:"run"`
-	Test  TestCommand  `description:"execute 'go test'  command"           command:"test"`
-	Build BuildCommand `description:"execute 'go build' command"           command:"build"`
+	Watch    WatchCommand    `description:"" command:"watch" hidden:"true"`
+	Init     InitCommand     `description:"create rebirth.yml for configuration" command:"init"`
+	Run      RunCommand      `description:"execute 'go run'   command"           command:"run"`
+	Test     TestCommand     `description:"execute 'go test'  command"           command:"test"`
+	Build    BuildCommand    `description:"execute 'go build' command"           command:"build"`
+	Rollback RollbackCommand `description:"restart previous binary"             command:"rollback"`
 }
 
 type InitCommand struct{}
@@ -28,6 +31,7 @@ type RunCommand struct{}
 type TestCommand struct{}
 type BuildCommand struct{}
 type WatchCommand struct{}
+type RollbackCommand struct{}
 
 type TaskCommand struct {
 	tasks []string
@@ -58,6 +62,21 @@ func (cmd *RunCommand) Execute(args []string) error {
 			env = append(env, fmt.Sprintf("%s=%s", k, rebirth.ExpandPath(v)))
 		}
 		gocmd.AddEnv(env)
+		if len(args) > 0 {
+			// run.args are passed to the program, so they must follow the target.
+			args = append(args, cfg.Run.Args...)
+		}
+		if cfg.Run.Dir != "" {
+			gocmd.SetRunDir(rebirth.ExpandPath(cfg.Run.Dir))
+		}
+		if cfg.Run.Stdin {
+			gocmd.SetStdin(os.Stdin)
+		}
+	}
+	if cfg.Build != nil {
+		gocmd.AddBuildFlags(cfg.Build.Flags)
+		gocmd.AddTags(cfg.Build.Tags)
+		gocmd.AddLdflags(cfg.Build.Ldflags)
 	}
 	if cfg.Host != nil && cfg.Host.Docker != "" {
 		gocmd.EnableCrossBuild(cfg.Host.Docker)
@@ -83,6 +102,9 @@ func (cmd *TestCommand) Execute(args []string) error {
 			env = append(env, fmt.Sprintf("%s=%s", k, rebirth.ExpandPath(v)))
 		}
 		gocmd.AddEnv(env)
+		gocmd.AddBuildFlags(cfg.Build.Flags)
+		gocmd.AddTags(cfg.Build.Tags)
+		gocmd.AddLdflags(cfg.Build.Ldflags)
 	}
 	if cfg.Host != nil && cfg.Host.Docker != "" {
 		gocmd.EnableCrossBuild(cfg.Host.Docker)
@@ -102,29 +124,80 @@ func (cmd *BuildCommand) Execute(args []string) error {
 		return xerrors.Errorf("failed to load config: %w", err)
 	}
 	gocmd := rebirth.NewGoCommand()
+	var diagnostics *rebirth.Diagnostics
 	if cfg.Build != nil {
 		env := []string{}
 		for k, v := range cfg.Build.Env {
 			env = append(env, fmt.Sprintf("%s=%s", k, rebirth.ExpandPath(v)))
 		}
 		gocmd.AddEnv(env)
+		gocmd.AddBuildFlags(cfg.Build.Flags)
+		gocmd.AddTags(cfg.Build.Tags)
+		gocmd.AddLdflags(cfg.Build.Ldflags)
+		diagnostics = cfg.Build.Diagnostics
 	}
 	if cfg.Host != nil && cfg.Host.Docker != "" {
 		gocmd.EnableCrossBuild(cfg.Host.Docker)
 	}
-	if err := gocmd.Build(args...); err != nil {
+	reporter := rebirth.NewDiagnosticReporter(diagnostics)
+	if err := reporter.Validate(); err != nil {
+		return xerrors.Errorf("invalid build.diagnostics: %w", err)
+	}
+	capture := reporter.Capture()
+	gocmd.SetStderr(capture)
+	err = gocmd.Build(args...)
+	capture.Finish()
+	if err := reporter.Flush(); err != nil {
+		return xerrors.Errorf("failed to write diagnostics: %w", err)
+	}
+	if err != nil {
 		return xerrors.Errorf("failed to build: %w", err)
 	}
 	return nil
 }
 
-func (cmd *WatchCommand) run() error {
+// Execute restarts the binary of the generation. args are [process name] [generation].
+func (cmd *RollbackCommand) Execute(args []string) error {
+	if !rebirth.ExistsConfig() {
+		return xerrors.New("`rebirth init` must be executed before `rebirth rollback`")
+	}
+	cfg, err := rebirth.LoadConfig("rebirth.yml")
+	if err != nil {
+		return xerrors.Errorf("failed to load config: %w", err)
+	}
+	names := []string{}
+	generation := 0
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			generation = n
+			continue
+		}
+		names = append(names, arg)
+	}
+	supervisor, err := rebirth.NewSupervisor(cfg, names...)
+	if err != nil {
+		return xerrors.Errorf("failed to create supervisor: %w", err)
+	}
+	if err := supervisor.Rollback(generation); err != nil {
+		return xerrors.Errorf("failed to rollback: %w", err)
+	}
+	return nil
+}
+
+func (cmd *WatchCommand) run(names []string) error {
 	cfg, err := rebirth.LoadConfig("rebirth.yml")
 	if err != nil {
 		return xerrors.Errorf("failed to load config: %w", err)
 	}
 
-	reloader := rebirth.NewReloader(cfg)
+	reloader, err := rebirth.NewSupervisor(cfg, names...)
+	if err != nil {
+		return xerrors.Errorf("failed to create supervisor: %w", err)
+	}
+	watcher, err := rebirth.NewWatcher(cfg)
+	if err != nil {
+		return xerrors.Errorf("failed to create watcher: %w", err)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGQUIT)
@@ -133,6 +206,9 @@ func (cmd *WatchCommand) run() error {
 		for {
 			<-sig
 			fmt.Println("close...")
+			if err := watcher.Close(); err != nil {
+				log.Printf("%+v", err)
+			}
 			if err := reloader.Close(); err != nil {
 				log.Printf("%+v", err)
 			}
@@ -142,10 +218,8 @@ func (cmd *WatchCommand) run() error {
 
 	if reloader.IsEnabledReload() {
 		go func() {
-			if err := rebirth.NewWatcher(cfg).Run(func() {
-				if err := reloader.Reload(); err != nil {
-					fmt.Println(err)
-				}
+			if err := watcher.Run(func(ctx context.Context, changes *rebirth.ChangeSet) error {
+				return reloader.Handle(ctx, changes)
 			}); err != nil {
 				log.Printf("%+v", err)
 				os.Exit(1)
@@ -159,7 +233,7 @@ func (cmd *WatchCommand) run() error {
 }
 
 func (cmd *WatchCommand) Execute(args []string) error {
-	if err := cmd.run(); err != nil {
+	if err := cmd.run(args); err != nil {
 		if xerrors.Is(err, errors.ErrCrossCompiler) {
 			return errors.ErrCrossCompiler
 		}
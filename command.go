@@ -12,6 +12,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -22,16 +26,38 @@ import (
 )
 
 type Command struct {
-	cmd  *exec.Cmd
-	args []string
+	cmd         *exec.Cmd
+	args        []string
+	stdin       io.Reader
+	stdout      io.Writer
+	stderr      io.Writer
+	stopSignal  os.Signal
+	stopTimeout time.Duration
+	done        chan struct{}
+	ctx         context.Context
+
+	// pipes copy stdout and stderr to writers that are not *os.File.
+	// Stop closes them if processes escaped from the process group keep the write ends open.
+	pipes   []*outputPipe
+	copying sync.WaitGroup
+
+	isProcessGroup bool
+	stopRequested  int32
 }
 
+const defaultStopTimeout = 5 * time.Second
+
 func NewCommand(args ...string) *Command {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Env = os.Environ()
 	return &Command{
-		cmd:  cmd,
-		args: args,
+		cmd:         cmd,
+		args:        args,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		stopSignal:  syscall.SIGTERM,
+		stopTimeout: defaultStopTimeout,
+		done:        make(chan struct{}),
 	}
 }
 
@@ -39,6 +65,39 @@ func (c *Command) SetDir(dir string) {
 	c.cmd.Dir = dir
 }
 
+// SetStopSignal sets the signal sent by Stop before killing the process.
+func (c *Command) SetStopSignal(sig os.Signal) {
+	c.stopSignal = sig
+}
+
+// SetStopTimeout sets the duration to wait for exit after sending the stop signal.
+func (c *Command) SetStopTimeout(timeout time.Duration) {
+	c.stopTimeout = timeout
+}
+
+// SetExtraFiles sets open files inherited by the process. The first file becomes file descriptor 3.
+func (c *Command) SetExtraFiles(files []*os.File) {
+	c.cmd.ExtraFiles = files
+}
+
+// SetContext sets context for Run. The process is stopped by Stop when the context is done.
+func (c *Command) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// SetStdin sets reader for stdin of the process. It's empty by default.
+func (c *Command) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *Command) SetStdout(w io.Writer) {
+	c.stdout = w
+}
+
+func (c *Command) SetStderr(w io.Writer) {
+	c.stderr = w
+}
+
 func (c *Command) AddEnv(env []string) {
 	c.cmd.Env = append(c.cmd.Env, env...)
 }
@@ -60,58 +119,281 @@ func (c *Command) Stop() error {
 	if c.cmd.Process == nil {
 		return nil
 	}
+	atomic.StoreInt32(&c.stopRequested, 1)
 	pid := c.cmd.Process.Pid
-	process, err := ps.FindProcess(pid)
-	if err != nil {
-		return xerrors.Errorf("failed to find process by pid(%d): %w", pid, err)
+	if !c.isProcessGroup {
+		process, err := ps.FindProcess(pid)
+		if err != nil {
+			return xerrors.Errorf("failed to find process by pid(%d): %w", pid, err)
+		}
+		if process == nil {
+			return nil
+		}
 	}
-	if process != nil {
-		if err := c.cmd.Process.Kill(); err != nil {
-			return xerrors.Errorf("failed to kill process: %w", err)
+	descendants := descendantProcesses(pid)
+	if err := c.signal(c.stopSignal); err != nil {
+		return xerrors.Errorf("failed to send %s: %w", c.stopSignal, err)
+	}
+	if !c.waitExit(time.After(c.stopTimeout)) {
+		fmt.Printf("process(%d) didn't exit in %s after %s. kill it\n", pid, c.stopTimeout, c.stopSignal)
+		if err := c.signal(syscall.SIGKILL); err != nil {
+			return xerrors.Errorf("failed to kill: %w", err)
+		}
+		if !c.waitExit(time.After(killTimeout)) {
+			// SIGKILL can't be ignored, but the output is kept open by processes escaped from the process group.
+			fmt.Printf("output of process(%d) is still open after %s. close it\n", pid, killTimeout)
+			c.closePipes()
+			c.waitExit(time.After(killTimeout))
 		}
 	}
+	c.reportOrphans(descendants)
 	return nil
 }
 
-func (c *Command) Run() error {
-	if err := c.run(); err != nil {
-		return xerrors.Errorf("failed to run: %w", err)
+const killTimeout = 1 * time.Second
+
+// EnableProcessGroup runs the command in its own process group, and Stop sends signals to the whole group.
+func (c *Command) EnableProcessGroup() {
+	setProcessGroup(c.cmd)
+	c.isProcessGroup = true
+}
+
+func (c *Command) signal(sig os.Signal) error {
+	if c.isProcessGroup {
+		return signalProcessGroup(c.cmd.Process.Pid, sig)
+	}
+	if err := c.cmd.Process.Signal(sig); err != nil {
+		if c.isExited() {
+			return nil
+		}
+		return xerrors.Errorf("failed to send %s to process: %w", sig, err)
 	}
 	return nil
 }
 
-func (c *Command) RunAsync() {
-	go func() {
-		if err := c.run(); err != nil {
-			fmt.Println(err)
+// waitExit waits for exit of the process ( and all processes in its process group ) until timeout.
+func (c *Command) waitExit(timeout <-chan time.Time) bool {
+	select {
+	case <-c.done:
+	case <-timeout:
+		return false
+	}
+	if !c.isProcessGroup {
+		return true
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if len(processGroupMembers(c.cmd.Process.Pid)) == 0 {
+			return true
 		}
-	}()
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return false
+		}
+	}
 }
 
-func (c *Command) run() error {
-	stdout, err := c.cmd.StdoutPipe()
+// reportOrphans prints processes spawned by the command that are still alive after stopping it.
+func (c *Command) reportOrphans(descendants []ps.Process) {
+	orphans := []string{}
+	for _, process := range descendants {
+		alive, err := ps.FindProcess(process.Pid())
+		if err != nil || alive == nil || alive.Executable() != process.Executable() {
+			continue
+		}
+		orphans = append(orphans, fmt.Sprintf("%s(%d)", process.Executable(), process.Pid()))
+	}
+	if len(orphans) > 0 {
+		fmt.Printf("orphaned processes remain after stopping process(%d): %s\n", c.cmd.Process.Pid, strings.Join(orphans, ", "))
+	}
+}
+
+// descendantProcesses returns all child processes of pid recursively.
+func descendantProcesses(pid int) []ps.Process {
+	processes, err := ps.Processes()
 	if err != nil {
-		return xerrors.Errorf("failed to pipe stdout: %w", err)
+		return nil
 	}
-	stderr, err := c.cmd.StderrPipe()
+	children := map[int][]ps.Process{}
+	for _, process := range processes {
+		children[process.PPid()] = append(children[process.PPid()], process)
+	}
+	descendants := []ps.Process{}
+	parents := []int{pid}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		for _, child := range children[parent] {
+			descendants = append(descendants, child)
+			parents = append(parents, child.Pid())
+		}
+	}
+	return descendants
+}
+
+// Done returns a channel that's closed when the process exits.
+func (c *Command) Done() <-chan struct{} {
+	return c.done
+}
+
+// ProcessState returns the exit status of the process. It is available after Done is closed.
+func (c *Command) ProcessState() *os.ProcessState {
+	return c.cmd.ProcessState
+}
+
+// IsStopRequested reports whether the process is exited by Stop.
+func (c *Command) IsStopRequested() bool {
+	return atomic.LoadInt32(&c.stopRequested) == 1
+}
+
+func (c *Command) isExited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Command) Run() error {
+	if c.ctx != nil {
+		if err := c.ctx.Err(); err != nil {
+			return xerrors.Errorf("canceled before start: %w", err)
+		}
+	}
+	if err := c.start(); err != nil {
+		return xerrors.Errorf("failed to start: %w", err)
+	}
+	if c.ctx == nil {
+		if err := c.wait(); err != nil {
+			return xerrors.Errorf("failed to run: %w", err)
+		}
+		return nil
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.wait()
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return xerrors.Errorf("failed to run: %w", err)
+		}
+		return nil
+	case <-c.ctx.Done():
+		if err := c.Stop(); err != nil {
+			return xerrors.Errorf("failed to stop canceled process: %w", err)
+		}
+		<-errCh
+		return xerrors.Errorf("canceled: %w", c.ctx.Err())
+	}
+}
+
+// RunAsync starts the command and waits for exit in background.
+// Process is available after returning from RunAsync, so it can be stopped immediately.
+// The exit status is available by Done and ProcessState.
+func (c *Command) RunAsync() error {
+	if err := c.start(); err != nil {
+		return xerrors.Errorf("failed to start: %w", err)
+	}
+	go c.wait()
+	return nil
+}
+
+func (c *Command) start() error {
+	c.cmd.Stdin = c.stdin
+	stdout, err := c.pipe(c.stdout)
 	if err != nil {
-		return xerrors.Errorf("failed to pipe stderr: %w", err)
+		return c.startFailed(xerrors.Errorf("failed to create pipe for stdout: %w", err))
 	}
-	if err := c.cmd.Start(); err != nil {
-		return xerrors.Errorf("failed to run build command: %w", err)
+	stderr := stdout
+	if !isSameWriter(c.stdout, c.stderr) {
+		stderr, err = c.pipe(c.stderr)
+		if err != nil {
+			return c.startFailed(xerrors.Errorf("failed to create pipe for stderr: %w", err))
+		}
 	}
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
-	if err := c.cmd.Wait(); err != nil {
-		return err
+	c.cmd.Stdout = stdout
+	c.cmd.Stderr = stderr
+	if err := c.cmd.Start(); err != nil {
+		return c.startFailed(xerrors.Errorf("failed to run build command: %w", err))
+	}
+	for _, p := range c.pipes {
+		// the process has its own copy of the write end.
+		p.w.Close()
+		c.copying.Add(1)
+		go func(p *outputPipe) {
+			defer c.copying.Done()
+			io.Copy(p.dst, p.r)
+			p.r.Close()
+		}(p)
 	}
 	return nil
 }
 
+// outputPipe is the pipe from the process to the writer.
+type outputPipe struct {
+	r, w *os.File
+	dst  io.Writer
+}
+
+// pipe returns the writer passed to the process for w.
+// *os.File is passed as is, and the other writers are written through the pipe.
+func (c *Command) pipe(w io.Writer) (io.Writer, error) {
+	if _, isFile := w.(*os.File); isFile || w == nil {
+		return w, nil
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create pipe: %w", err)
+	}
+	c.pipes = append(c.pipes, &outputPipe{r: r, w: pw, dst: w})
+	return pw, nil
+}
+
+func (c *Command) startFailed(err error) error {
+	for _, p := range c.pipes {
+		p.w.Close()
+	}
+	c.closePipes()
+	close(c.done)
+	return err
+}
+
+// closePipes stops copying the output. Reading from the closed pipe returns immediately.
+func (c *Command) closePipes() {
+	for _, p := range c.pipes {
+		p.r.Close()
+	}
+}
+
+// isSameWriter reports whether stdout and stderr are the same writer, so they share the pipe like exec.Cmd.
+func isSameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			// the writer is not comparable.
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// wait waits for exit of the process and reaps it.
+// The output is copied until all processes having the pipes exit or Stop closes the pipes.
+func (c *Command) wait() error {
+	defer close(c.done)
+	err := c.cmd.Wait()
+	c.copying.Wait()
+	return err
+}
+
 type DockerCommand struct {
 	container string
 	cmd       []string
 	execID    string
+	stdin     io.Reader
 }
 
 func NewDockerCommand(container string, cmd ...string) *DockerCommand {
@@ -121,6 +403,11 @@ func NewDockerCommand(container string, cmd ...string) *DockerCommand {
 	}
 }
 
+// SetStdin sets reader for stdin of the command on the container.
+func (c *DockerCommand) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
 /*
 type DockerProcess struct {
 	Pid int
@@ -178,6 +465,7 @@ func (c *DockerCommand) run(ctx context.Context, ioCallback func(reader *bufio.R
 		return xerrors.Errorf("failed to create docker client: %w", err)
 	}
 	cfg := types.ExecConfig{
+		AttachStdin:  c.stdin != nil,
 		AttachStdout: true,
 		AttachStderr: true,
 		Cmd:          c.cmd,
@@ -193,9 +481,22 @@ func (c *DockerCommand) run(ctx context.Context, ioCallback func(reader *bufio.R
 		return xerrors.Errorf("failed to ContainerExecAttach: %w", err)
 	}
 	defer attachResp.Close()
+	if c.stdin != nil {
+		go func() {
+			io.Copy(attachResp.Conn, c.stdin)
+			attachResp.CloseWrite()
+		}()
+	}
 	if err := ioCallback(attachResp.Reader); err != nil {
 		return xerrors.Errorf("failed to i/o callback: %w", err)
 	}
+	inspectResp, err := cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return xerrors.Errorf("failed to ContainerExecInspect: %w", err)
+	}
+	if inspectResp.ExitCode != 0 {
+		return xerrors.Errorf("%s exited with code %d", strings.Join(c.cmd, " "), inspectResp.ExitCode)
+	}
 	return nil
 }
 
@@ -209,6 +510,13 @@ type GoCommand struct {
 	isCrossBuild bool
 	extEnv       []string
 	dir          string
+	stderr       io.Writer
+	stdin        io.Reader
+	runDir       string
+	flags        []string
+	tags         []string
+	ldflags      []string
+	ctx          context.Context
 }
 
 func NewGoCommand() *GoCommand {
@@ -230,9 +538,80 @@ func (c *GoCommand) SetDir(dir string) {
 	c.dir = dir
 }
 
+// SetContext sets context for go commands and commands run by RunInGoContext.
+// When the context is done, the running command is stopped with its subprocesses.
+func (c *GoCommand) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// AddBuildFlags adds flags for go build, go run and go test ( e.g. -race, -trimpath ).
+// -ldflags in flags is merged with other linker flags.
+func (c *GoCommand) AddBuildFlags(flags []string) {
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		switch {
+		case flag == "-ldflags" || flag == "--ldflags":
+			if i+1 < len(flags) {
+				c.ldflags = append(c.ldflags, flags[i+1])
+				i++
+			}
+		case strings.HasPrefix(flag, "-ldflags="):
+			c.ldflags = append(c.ldflags, strings.TrimPrefix(flag, "-ldflags="))
+		case strings.HasPrefix(flag, "--ldflags="):
+			c.ldflags = append(c.ldflags, strings.TrimPrefix(flag, "--ldflags="))
+		case flag == "-tags" || flag == "--tags":
+			if i+1 < len(flags) {
+				c.AddTags(splitTags(flags[i+1]))
+				i++
+			}
+		case strings.HasPrefix(flag, "-tags="):
+			c.AddTags(splitTags(strings.TrimPrefix(flag, "-tags=")))
+		case strings.HasPrefix(flag, "--tags="):
+			c.AddTags(splitTags(strings.TrimPrefix(flag, "--tags=")))
+		default:
+			c.flags = append(c.flags, flag)
+		}
+	}
+}
+
+// splitTags splits the value of -tags. go accepts both comma and space separated lists.
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// AddTags adds build tags.
+func (c *GoCommand) AddTags(tags []string) {
+	c.tags = append(c.tags, tags...)
+}
+
+// AddLdflags adds flags passed to the linker.
+func (c *GoCommand) AddLdflags(ldflags string) {
+	if ldflags == "" {
+		return
+	}
+	c.ldflags = append(c.ldflags, ldflags)
+}
+
+// SetStdin sets reader for stdin of the program executed by Run.
+func (c *GoCommand) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+// SetRunDir sets working directory of the program executed by Run.
+func (c *GoCommand) SetRunDir(dir string) {
+	c.runDir = dir
+}
+
+// SetStderr sets writer for stderr of go command and RunInGoContext. os.Stderr is used by default.
+func (c *GoCommand) SetStderr(w io.Writer) {
+	c.stderr = w
+}
+
 func (c *GoCommand) RunInGoContext(args ...string) error {
 	cmd := NewCommand(args...)
-	env := []string{}
+	env := append([]string{}, c.extEnv...)
 	if c.dir == "" {
 		symlinkPath, err := c.getOrCreateSymlink()
 		if err != nil {
@@ -249,6 +628,10 @@ func (c *GoCommand) RunInGoContext(args ...string) error {
 		cmd.SetDir(c.dir)
 	}
 	cmd.AddEnv(env)
+	if c.stderr != nil {
+		cmd.SetStderr(c.stderr)
+	}
+	c.setContextTo(cmd)
 	if err := cmd.Run(); err != nil {
 		return xerrors.Errorf("failed to command: %w", err)
 	}
@@ -257,7 +640,7 @@ func (c *GoCommand) RunInGoContext(args ...string) error {
 
 func (c *GoCommand) Build(args ...string) error {
 	cmd := []string{"go", "build"}
-	cmd = append(cmd, c.linkerFlags()...)
+	cmd = append(cmd, c.buildFlags()...)
 	cmd = append(cmd, args...)
 	if err := c.run(cmd...); err != nil {
 		return xerrors.Errorf("failed to run: %w", err)
@@ -265,21 +648,45 @@ func (c *GoCommand) Build(args ...string) error {
 	return nil
 }
 
+// List returns output of `go list`.
+func (c *GoCommand) List(args ...string) ([]byte, error) {
+	cmd := []string{"go", "list"}
+	if len(c.tags) > 0 {
+		cmd = append(cmd, "-tags", strings.Join(c.tags, ","))
+	}
+	cmd = append(cmd, args...)
+	out, err := c.output(cmd...)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to run: %w", err)
+	}
+	return out, nil
+}
+
+func (c *GoCommand) ModDownload() error {
+	if err := c.run("go", "mod", "download"); err != nil {
+		return xerrors.Errorf("failed to run: %w", err)
+	}
+	return nil
+}
+
 func (c *GoCommand) Run(args ...string) error {
-	if !c.isCrossBuild {
+	if !c.isCrossBuild && c.runDir == "" {
 		cmd := []string{"go", "run"}
-		cmd = append(cmd, c.linkerFlags()...)
+		cmd = append(cmd, c.buildFlags()...)
 		cmd = append(cmd, args...)
-		if err := c.run(cmd...); err != nil {
+		goCmd, err := c.command(cmd...)
+		if err != nil {
+			return xerrors.Errorf("failed to create command: %w", err)
+		}
+		goCmd.SetStdin(c.stdin)
+		if err := goCmd.Run(); err != nil {
 			return xerrors.Errorf("failed to run: %w", err)
 		}
 		return nil
 	}
 
-	if len(args) == 0 {
-		return xerrors.New("go run: no go files listed")
-	}
-	if filepath.Ext(args[0]) != ".go" {
+	target, goargs := splitRunTarget(args)
+	if len(target) == 0 {
 		return xerrors.New("go run: no go files listed")
 	}
 	tmpfile, err := ioutil.TempFile(configDir, "script")
@@ -287,29 +694,63 @@ func (c *GoCommand) Run(args ...string) error {
 		return xerrors.Errorf("failed to create temporary file: %w", err)
 	}
 	defer os.Remove(tmpfile.Name())
-	gofile := args[0]
-	var goargs []string
-	if len(args) > 1 {
-		goargs = args[1:]
-	}
+	gofile := strings.Join(target, " ")
 	cmd := []string{"go", "build", "-o", tmpfile.Name()}
-	cmd = append(cmd, c.linkerFlags()...)
-	cmd = append(cmd, gofile)
+	cmd = append(cmd, c.buildFlags()...)
+	cmd = append(cmd, target...)
 	if err := c.run(cmd...); err != nil {
 		return xerrors.Errorf("failed to run: %w", err)
 	}
+	if !c.isCrossBuild {
+		program, err := filepath.Abs(tmpfile.Name())
+		if err != nil {
+			return xerrors.Errorf("failed to get absolute path of %s: %w", tmpfile.Name(), err)
+		}
+		execCmd := NewCommand(append([]string{program}, goargs...)...)
+		execCmd.SetDir(c.runDir)
+		execCmd.SetStdin(c.stdin)
+		execCmd.AddEnv(c.extEnv)
+		if err := execCmd.Run(); err != nil {
+			return xerrors.Errorf("failed to run %s: %w", gofile, err)
+		}
+		return nil
+	}
 	dockerCmd := []string{tmpfile.Name()}
+	if c.runDir != "" {
+		// docker exec doesn't support working directory on this API version.
+		dockerCmd = []string{"/bin/sh", "-c", runInDirScript, c.runDir, tmpfile.Name()}
+	}
 	dockerCmd = append(dockerCmd, goargs...)
-	if err := NewDockerCommand(c.container, dockerCmd...).Run(); err != nil {
+	docker := NewDockerCommand(c.container, dockerCmd...)
+	if c.stdin != nil {
+		docker.SetStdin(c.stdin)
+	}
+	if err := docker.Run(); err != nil {
 		return xerrors.Errorf("failed to run on docker container: %w", err)
 	}
 	return nil
 }
 
+// splitRunTarget splits arguments of `go run` into the target and arguments of the program.
+// The target is leading go files, or a package path like `go run`.
+func splitRunTarget(args []string) ([]string, []string) {
+	n := 0
+	for n < len(args) && filepath.Ext(args[n]) == ".go" {
+		n++
+	}
+	if n == 0 && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		n = 1
+	}
+	return args[:n], args[n:]
+}
+
+// runInDirScript executes "$1" ( relative path from the current directory ) with arguments in directory "$0".
+const runInDirScript = `program="$PWD/$1"; shift; cd "$0" && exec "$program" "$@"`
+
 func (c *GoCommand) Test(args ...string) error {
 	if !c.isCrossBuild {
 		cmd := []string{"go", "test"}
-		cmd = append(cmd, c.linkerFlags()...)
+		cmd = append(cmd, c.buildFlags()...)
 		cmd = append(cmd, args...)
 		if err := c.run(cmd...); err != nil {
 			return xerrors.Errorf("failed to run: %w", err)
@@ -318,7 +759,7 @@ func (c *GoCommand) Test(args ...string) error {
 	}
 
 	cmd := []string{"go", "test", "-c", "-o", filepath.Join(configDir, "app.test")}
-	cmd = append(cmd, c.linkerFlags()...)
+	cmd = append(cmd, c.buildFlags()...)
 	cmd = append(cmd, args...)
 	if err := c.run(cmd...); err != nil {
 		return xerrors.Errorf("failed to run: %w", err)
@@ -340,30 +781,37 @@ func (c *GoCommand) Test(args ...string) error {
 	return nil
 }
 
-func (c *GoCommand) linkerFlags() []string {
+// buildFlags returns flags for go build, go run and go test.
+// Linker flags for static cross build are merged with user's linker flags into single -ldflags.
+func (c *GoCommand) buildFlags() []string {
+	flags := append([]string{}, c.flags...)
+	if len(c.tags) > 0 {
+		flags = append(flags, "-tags", strings.Join(c.tags, ","))
+	}
+	ldflags := append([]string{}, c.ldflags...)
 	if c.isCrossBuild {
-		return []string{
-			"--ldflags",
-			`-linkmode external -extldflags "-static"`,
-		}
+		ldflags = append(ldflags, `-linkmode external -extldflags "-static"`)
 	}
-	return []string{}
+	if len(ldflags) > 0 {
+		flags = append(flags, "-ldflags", strings.Join(ldflags, " "))
+	}
+	return flags
 }
 
-func (c *GoCommand) run(args ...string) error {
+func (c *GoCommand) command(args ...string) (*Command, error) {
 	env, err := c.buildEnv()
 	if err != nil {
-		return xerrors.Errorf("failed to get build env: %w", err)
+		return nil, xerrors.Errorf("failed to get build env: %w", err)
 	}
 	cmd := NewCommand(args...)
 	if c.dir == "" {
 		symlinkPath, err := c.getOrCreateSymlink()
 		if err != nil {
-			return xerrors.Errorf("failed to get symlink path: %w", err)
+			return nil, xerrors.Errorf("failed to get symlink path: %w", err)
 		}
 		gopath, err := c.gopath()
 		if err != nil {
-			return xerrors.Errorf("failed to get GOPATH: %w", err)
+			return nil, xerrors.Errorf("failed to get GOPATH: %w", err)
 		}
 		env = append(env, fmt.Sprintf("GOPATH=%s", gopath))
 		env = append(env, fmt.Sprintf("PATH=%s:%s/bin", os.Getenv("PATH"), gopath))
@@ -372,12 +820,46 @@ func (c *GoCommand) run(args ...string) error {
 		cmd.SetDir(c.dir)
 	}
 	cmd.AddEnv(env)
+	if c.stderr != nil {
+		cmd.SetStderr(c.stderr)
+	}
+	c.setContextTo(cmd)
+	return cmd, nil
+}
+
+func (c *GoCommand) setContextTo(cmd *Command) {
+	if c.ctx == nil {
+		return
+	}
+	cmd.SetContext(c.ctx)
+	// go build runs compilers as subprocesses. stop them together.
+	cmd.EnableProcessGroup()
+}
+
+func (c *GoCommand) run(args ...string) error {
+	cmd, err := c.command(args...)
+	if err != nil {
+		return xerrors.Errorf("failed to create command: %w", err)
+	}
 	if err := cmd.Run(); err != nil {
 		return xerrors.Errorf("failed to command: %w", err)
 	}
 	return nil
 }
 
+func (c *GoCommand) output(args ...string) ([]byte, error) {
+	cmd, err := c.command(args...)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create command: %w", err)
+	}
+	var stdout bytes.Buffer
+	cmd.SetStdout(&stdout)
+	if err := cmd.Run(); err != nil {
+		return nil, xerrors.Errorf("failed to command: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
 func (c *GoCommand) buildEnv() ([]string, error) {
 	goos, err := c.buildGOOS()
 	if err != nil {
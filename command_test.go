@@ -0,0 +1,148 @@
+package rebirth
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is written by the goroutine copying the output and read by the test.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCommandOutput(t *testing.T) {
+	var stdout, stderr lockedBuffer
+	cmd := NewCommand("sh", "-c", "echo out; echo err >&2")
+	cmd.SetStdout(&stdout)
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("unexpected output: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestCommandStopWithEscapedProcess(t *testing.T) {
+	var stdout lockedBuffer
+	// the escaped process keeps stdout open after the process group is killed.
+	cmd := NewCommand("sh", "-c", "setsid sleep 5 2>/dev/null & echo started; trap '' TERM; while true; do sleep 0.1; done")
+	cmd.SetStdout(&stdout)
+	cmd.SetStopTimeout(100 * time.Millisecond)
+	cmd.EnableProcessGroup()
+	if err := cmd.RunAsync(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(stdout.String(), "started") {
+		if time.Now().After(deadline) {
+			t.Fatal("process is not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- cmd.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Stop should return even if the output is kept open")
+	}
+	select {
+	case <-cmd.Done():
+	default:
+		t.Fatal("Done should be closed after Stop")
+	}
+}
+
+func TestSplitRunTarget(t *testing.T) {
+	tests := []struct {
+		args   []string
+		target []string
+		rest   []string
+	}{
+		{args: []string{"main.go"}, target: []string{"main.go"}, rest: []string{}},
+		{args: []string{"main.go", "util.go", "-port", "1323"}, target: []string{"main.go", "util.go"}, rest: []string{"-port", "1323"}},
+		{args: []string{"./cmd/app", "-port", "1323"}, target: []string{"./cmd/app"}, rest: []string{"-port", "1323"}},
+		{args: []string{"."}, target: []string{"."}, rest: []string{}},
+		{args: []string{"-port", "1323"}, target: []string{}, rest: []string{"-port", "1323"}},
+		{args: []string{}, target: []string{}, rest: []string{}},
+	}
+	for _, test := range tests {
+		target, rest := splitRunTarget(test.args)
+		if !reflect.DeepEqual(target, test.target) || !reflect.DeepEqual(rest, test.rest) {
+			t.Fatalf("unexpected split of %v: target %v, rest %v", test.args, target, rest)
+		}
+	}
+}
+
+func TestGoCommandBuildFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		flags      []string
+		tags       []string
+		ldflags    string
+		crossBuild bool
+		expected   []string
+	}{
+		{name: "empty", expected: []string{}},
+		{name: "flags", flags: []string{"-race", "-gcflags=all=-N -l"}, expected: []string{"-race", "-gcflags=all=-N -l"}},
+		{name: "tags", tags: []string{"integration", "debug"}, expected: []string{"-tags", "integration,debug"}},
+		{
+			name:     "tags in flags",
+			flags:    []string{"-tags", "integration,e2e", "-race", "-tags=netgo"},
+			tags:     []string{"debug"},
+			expected: []string{"-race", "-tags", "integration,e2e,netgo,debug"},
+		},
+		{name: "ldflags", ldflags: "-X main.version=dev", expected: []string{"-ldflags", "-X main.version=dev"}},
+		{
+			name:     "ldflags in flags",
+			flags:    []string{"-ldflags", "-s -w", "--ldflags=-X main.commit=abc"},
+			ldflags:  "-X main.version=dev",
+			expected: []string{"-ldflags", "-s -w -X main.commit=abc -X main.version=dev"},
+		},
+		{
+			name:       "cross build",
+			flags:      []string{"-trimpath", "-ldflags=-s -w"},
+			crossBuild: true,
+			expected:   []string{"-trimpath", "-ldflags", `-s -w -linkmode external -extldflags "-static"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gocmd := NewGoCommand()
+			gocmd.AddBuildFlags(test.flags)
+			gocmd.AddTags(test.tags)
+			gocmd.AddLdflags(test.ldflags)
+			if test.crossBuild {
+				gocmd.EnableCrossBuild("app")
+			}
+			flags := gocmd.buildFlags()
+			if !reflect.DeepEqual(flags, test.expected) {
+				t.Fatalf("unexpected flags: expected %q but got %q", test.expected, flags)
+			}
+		})
+	}
+}
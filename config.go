@@ -3,45 +3,167 @@ package rebirth
 import (
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"golang.org/x/xerrors"
 )
 
 type Config struct {
-	Host  *Host            `yaml:"host,omitempty"`
-	Build *Build           `yaml:"build,omitempty"`
-	Run   *Run             `yaml:"run,omitempty"`
-	Watch *Watch           `yaml:"watch,omitempty"`
-	Task  map[string]*Task `yaml:"task,omitempty"`
+	Host       *Host               `yaml:"host,omitempty"`
+	Build      *Build              `yaml:"build,omitempty"`
+	Run        *Run                `yaml:"run,omitempty"`
+	Watch      *Watch              `yaml:"watch,omitempty"`
+	Task       map[string]*Task    `yaml:"task,omitempty"`
+	Proxy      *Proxy              `yaml:"proxy,omitempty"`
+	LiveReload *LiveReload         `yaml:"live_reload,omitempty"`
+	Processes  map[string]*Process `yaml:"processes,omitempty"`
+}
+
+// Process is the application managed with other processes by one rebirth.
+// Build and Run inherit top-level settings.
+type Process struct {
+	Build      *Build      `yaml:"build,omitempty"`
+	Run        *Run        `yaml:"run,omitempty"`
+	Prefix     string      `yaml:"prefix,omitempty"`
+	Proxy      *Proxy      `yaml:"proxy,omitempty"`
+	LiveReload *LiveReload `yaml:"live_reload,omitempty"`
 }
 
 type Host struct {
 	Docker string `yaml:"docker,omitempty"`
 }
 
+// Build is settings for building the application.
+// Flags, Tags and Ldflags are also used by `rebirth build`, `rebirth run` and `rebirth test`.
 type Build struct {
-	Main   string            `yaml:"main,omitempty"`
-	Env    map[string]string `yaml:"env,omitempty"`
-	Init   []string          `yaml:"init,omitempty"`
-	Before []string          `yaml:"before,omitempty"`
-	After  []string          `yaml:"after,omitempty"`
+	Main        string            `yaml:"main,omitempty"`
+	Env         map[string]string `yaml:"env,omitempty"`
+	Init        []string          `yaml:"init,omitempty"`
+	Before      []string          `yaml:"before,omitempty"`
+	After       []string          `yaml:"after,omitempty"`
+	ModDownload string            `yaml:"mod_download,omitempty"`
+	Flags       []string          `yaml:"flags,omitempty"`
+	Tags        []string          `yaml:"tags,omitempty"`
+	Ldflags     string            `yaml:"ldflags,omitempty"`
+	History     int               `yaml:"history,omitempty"`
+	Diagnostics *Diagnostics      `yaml:"diagnostics,omitempty"`
+}
+
+// Diagnostics is the format of errors reported by go build and build hooks for editors.
+type Diagnostics struct {
+	Format string `yaml:"format,omitempty"`
+	Output string `yaml:"output,omitempty"`
 }
 
+const (
+	ModDownloadLocal  = "local"
+	ModDownloadDocker = "docker"
+)
+
 type Run struct {
-	Env map[string]string `yaml:"env,omitempty"`
+	Env          map[string]string `yaml:"env,omitempty"`
+	Args         []string          `yaml:"args,omitempty"`
+	Dir          string            `yaml:"dir,omitempty"`
+	Stdin        bool              `yaml:"stdin,omitempty"`
+	StopSignal   string            `yaml:"stop_signal,omitempty"`
+	StopTimeout  Duration          `yaml:"stop_timeout,omitempty"`
+	Ports        []int             `yaml:"ports,omitempty"`
+	PortTimeout  Duration          `yaml:"port_timeout,omitempty"`
+	Restart      string            `yaml:"restart,omitempty"`
+	MaxRetries   *int              `yaml:"max_retries,omitempty"`
+	RestartDelay Duration          `yaml:"restart_delay,omitempty"`
+	Listen       []string          `yaml:"listen,omitempty"`
+	Ready        []*ReadyCheck     `yaml:"ready,omitempty"`
+	AfterReady   []string          `yaml:"after_ready,omitempty"`
+	Debug        *Debug            `yaml:"debug,omitempty"`
+}
+
+// Debug runs the application under Delve headless server.
+type Debug struct {
+	Port     int  `yaml:"port,omitempty"`
+	Continue bool `yaml:"continue,omitempty"`
+}
+
+// ReadyCheck is the check for the started application. One of TCP, HTTP or Log is required.
+type ReadyCheck struct {
+	TCP     string   `yaml:"tcp,omitempty"`
+	HTTP    string   `yaml:"http,omitempty"`
+	Status  int      `yaml:"status,omitempty"`
+	Log     string   `yaml:"log,omitempty"`
+	Timeout Duration `yaml:"timeout,omitempty"`
+}
+
+// Proxy is the reverse proxy in front of the application.
+type Proxy struct {
+	Listen  string   `yaml:"listen,omitempty"`
+	Target  string   `yaml:"target,omitempty"`
+	Timeout Duration `yaml:"timeout,omitempty"`
+}
+
+// LiveReload is the endpoint to reload browsers after restarting the application.
+type LiveReload struct {
+	Listen string `yaml:"listen,omitempty"`
+	Inject bool   `yaml:"inject,omitempty"`
 }
 
 type Watch struct {
-	Root   string   `yaml:"root,omitempty"`
-	Ignore []string `yaml:"ignore,omitempty"`
+	Root     string   `yaml:"root,omitempty"`
+	Ignore   []string `yaml:"ignore,omitempty"`
+	Include  []string `yaml:"include,omitempty"`
+	Exclude  []string `yaml:"exclude,omitempty"`
+	Mode     string   `yaml:"mode,omitempty"`
+	Interval Duration `yaml:"interval,omitempty"`
+	Delay    Duration `yaml:"delay,omitempty"`
+	MaxWait  Duration `yaml:"max_wait,omitempty"`
+	Rules    []*Rule  `yaml:"rules,omitempty"`
+	DepsOnly bool     `yaml:"deps_only,omitempty"`
 }
 
+// Rule maps changed files to the action.
+type Rule struct {
+	Pattern string `yaml:"pattern,omitempty"`
+	Action  string `yaml:"action,omitempty"`
+	Task    string `yaml:"task,omitempty"`
+}
+
+const (
+	ActionRebuild = "rebuild"
+	ActionRestart = "restart"
+	ActionTask    = "task"
+	ActionIgnore  = "ignore"
+)
+
+const (
+	WatchModeNotify = "notify"
+	WatchModePoll   = "poll"
+)
+
 type Task struct {
 	Desc     string   `yaml:"desc,omitempty"`
 	Commands []string `yaml:"commands,omitempty"`
 }
 
+// Duration is time.Duration written as string like `500ms` or `2s` in rebirth.yml
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return xerrors.Errorf("failed to decode duration: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return xerrors.Errorf("failed to parse duration %s: %w", s, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
 func LoadConfig(confPath string) (*Config, error) {
 	file, err := ioutil.ReadFile(confPath)
 	if err != nil {
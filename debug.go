@@ -0,0 +1,49 @@
+package rebirth
+
+import (
+	"fmt"
+)
+
+const (
+	defaultDebugPort = 2345
+
+	// debugGCFlags disables optimizations and inlining so that Delve can inspect variables and set breakpoints.
+	debugGCFlags = "-gcflags=all=-N -l"
+)
+
+func (d *Debug) port() int {
+	if d.Port > 0 {
+		return d.Port
+	}
+	return defaultDebugPort
+}
+
+// listenAddr returns the address of Delve headless server.
+// On the docker container, it listens on all interfaces to be reachable by the published port.
+func (d *Debug) listenAddr(onContainer bool) string {
+	if onContainer {
+		return fmt.Sprintf(":%d", d.port())
+	}
+	return fmt.Sprintf("127.0.0.1:%d", d.port())
+}
+
+// debugArgs returns the command line to run the program under Delve headless server.
+// `--accept-multiclient` keeps the server after the client disconnected, and it is required by `--continue`.
+func debugArgs(d *Debug, onContainer bool, program string, args []string) []string {
+	dlvArgs := []string{
+		"dlv", "exec",
+		"--headless",
+		fmt.Sprintf("--listen=%s", d.listenAddr(onContainer)),
+		"--api-version=2",
+		"--accept-multiclient",
+	}
+	if d.Continue {
+		dlvArgs = append(dlvArgs, "--continue")
+	}
+	dlvArgs = append(dlvArgs, program)
+	if len(args) > 0 {
+		dlvArgs = append(dlvArgs, "--")
+		dlvArgs = append(dlvArgs, args...)
+	}
+	return dlvArgs
+}
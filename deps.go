@@ -0,0 +1,137 @@
+package rebirth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+type depPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	Imports    []string
+}
+
+// depGraph is the cached import graph of the main package resolved by `go list -deps -json`.
+// It is refreshed when imports of the package in the graph are changed.
+type depGraph struct {
+	main    string
+	gocmd   *GoCommand
+	mu      sync.Mutex
+	pkgs    map[string]*depPackage
+	isStale bool
+}
+
+func newDepGraph(main string, gocmd *GoCommand) *depGraph {
+	return &depGraph{
+		main:    main,
+		gocmd:   gocmd,
+		isStale: true,
+	}
+}
+
+func (g *depGraph) invalidate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.isStale = true
+}
+
+func (g *depGraph) load() error {
+	out, err := g.gocmd.List("-deps", "-json", g.main)
+	if err != nil {
+		return xerrors.Errorf("failed to list dependencies of %s: %w", g.main, err)
+	}
+	pkgs := map[string]*depPackage{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg depPackage
+		if err := dec.Decode(&pkg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return xerrors.Errorf("failed to decode output of go list: %w", err)
+		}
+		if pkg.Standard || pkg.Dir == "" {
+			continue
+		}
+		dir, err := realPath(pkg.Dir)
+		if err != nil {
+			continue
+		}
+		pkgs[dir] = &pkg
+	}
+	g.pkgs = pkgs
+	g.isStale = false
+	return nil
+}
+
+// affects reports whether the changed file affects the main package.
+// If it doesn't, the reason is returned too.
+func (g *depGraph) affects(path string) (bool, string, error) {
+	if filepath.Ext(path) != ".go" {
+		return true, "", nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.isStale {
+		if err := g.load(); err != nil {
+			return true, "", xerrors.Errorf("failed to load dependency graph: %w", err)
+		}
+	}
+	dir, err := realPath(filepath.Dir(path))
+	if err != nil {
+		return true, "", nil
+	}
+	pkg, exists := g.pkgs[dir]
+	if !exists {
+		return false, fmt.Sprintf("%s is not in the dependency graph of %s", path, g.main), nil
+	}
+	if g.hasNewImports(pkg, path) {
+		// imported packages are changed. the graph is reloaded for next events.
+		g.isStale = true
+	}
+	return true, "", nil
+}
+
+func (g *depGraph) hasNewImports(pkg *depPackage, path string) bool {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	imports := map[string]struct{}{}
+	for _, imp := range pkg.Imports {
+		imports[imp] = struct{}{}
+	}
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if _, exists := imports[importPath]; !exists {
+			return true
+		}
+	}
+	return false
+}
+
+func realPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", xerrors.Errorf("failed to get absolute path from %s: %w", path, err)
+	}
+	evaluated, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", xerrors.Errorf("failed to evaluate symlink %s: %w", absPath, err)
+	}
+	return evaluated, nil
+}
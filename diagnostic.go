@@ -0,0 +1,270 @@
+package rebirth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	DiagnosticsText     = "text"
+	DiagnosticsQuickfix = "quickfix"
+	DiagnosticsJSON     = "json"
+)
+
+// diagnosticPattern matches `file:line:column: message` and `file:line: message` reported by the compiler, vet and linters.
+var diagnosticPattern = regexp.MustCompile(`^(?:vet: )?((?:[A-Za-z]:)?[^\s:]+):(\d+)(?::(\d+))?: (.*)$`)
+
+// Diagnostic is an error reported by go build or build hooks.
+// File is relative to the project root if it's in the project. File is empty if the line has no position.
+type Diagnostic struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+	Package string `json:"package,omitempty"`
+}
+
+// Quickfix returns the single line format for errorformat ( `%f:%l:%c: %m` ).
+func (d *Diagnostic) Quickfix() string {
+	msg := strings.Join(strings.Fields(d.Message), " ")
+	switch {
+	case d.File == "":
+		return msg
+	case d.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, msg)
+	default:
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, msg)
+	}
+}
+
+// diagnosticPaths rewrites paths under the GOPATH symlink ( .rebirth/src/<module> ) to the project paths.
+type diagnosticPaths struct {
+	modulePath string
+	prefixes   []string
+}
+
+func newDiagnosticPaths() *diagnosticPaths {
+	gocmd := NewGoCommand()
+	paths := &diagnosticPaths{}
+	modpath, err := gocmd.getModulePath()
+	if err != nil {
+		return paths
+	}
+	paths.modulePath = modpath
+	if srcPath, err := gocmd.srcPath(); err == nil {
+		paths.prefixes = append(paths.prefixes, filepath.Join(srcPath, modpath)+string(filepath.Separator))
+	}
+	paths.prefixes = append(paths.prefixes,
+		filepath.Join(configDir, "src", modpath)+string(filepath.Separator),
+		cwd+string(filepath.Separator),
+	)
+	return paths
+}
+
+func (p *diagnosticPaths) rewrite(line string) string {
+	for _, prefix := range p.prefixes {
+		line = strings.Replace(line, prefix, "", -1)
+	}
+	return line
+}
+
+// packageOf returns the import path of the package having the file in the project.
+func (p *diagnosticPaths) packageOf(file string) string {
+	if p.modulePath == "" || filepath.IsAbs(file) || strings.HasPrefix(file, "..") {
+		return ""
+	}
+	return path.Join(p.modulePath, filepath.ToSlash(filepath.Dir(file)))
+}
+
+// parseDiagnostics parses output of go build, go vet or build hooks.
+// Tab-indented lines are the continuation of the previous message, and `# package` lines are the package of following diagnostics.
+func parseDiagnostics(output string, paths *diagnosticPaths) []*Diagnostic {
+	diagnostics := []*Diagnostic{}
+	var pkg string
+	var last *Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "\t") && last != nil:
+			last.Message += "\n" + strings.TrimSpace(line)
+			continue
+		case strings.HasPrefix(line, "# "):
+			// `# pkg` by go build, `# [pkg]` or `# pkg [pkg.test]` by go vet.
+			fields := strings.Fields(strings.TrimPrefix(line, "# "))
+			pkg = strings.Trim(fields[0], "[]")
+			last = nil
+			continue
+		}
+		matched := diagnosticPattern.FindStringSubmatch(line)
+		if matched == nil {
+			last = &Diagnostic{Message: strings.TrimSpace(line), Package: pkg}
+			diagnostics = append(diagnostics, last)
+			continue
+		}
+		lineNum, _ := strconv.Atoi(matched[2])
+		column, _ := strconv.Atoi(matched[3])
+		file := filepath.Clean(paths.rewrite(matched[1]))
+		last = &Diagnostic{
+			File:    file,
+			Line:    lineNum,
+			Column:  column,
+			Message: matched[4],
+			Package: pkg,
+		}
+		if last.Package == "" {
+			last.Package = paths.packageOf(file)
+		}
+		diagnostics = append(diagnostics, last)
+	}
+	return diagnostics
+}
+
+// DiagnosticReporter reports output of go build and build hooks by `build.diagnostics` format.
+// The report of one build is also written to `build.diagnostics.output` by Flush.
+type DiagnosticReporter struct {
+	format string
+	output string
+	paths  *diagnosticPaths
+	w      io.Writer
+	mu     sync.Mutex
+	report bytes.Buffer
+}
+
+func NewDiagnosticReporter(cfg *Diagnostics) *DiagnosticReporter {
+	r := &DiagnosticReporter{
+		format: DiagnosticsText,
+		paths:  newDiagnosticPaths(),
+		w:      os.Stderr,
+	}
+	if cfg != nil {
+		if cfg.Format != "" {
+			r.format = cfg.Format
+		}
+		r.output = cfg.Output
+	}
+	return r
+}
+
+// Validate returns error if the format is unknown.
+func (r *DiagnosticReporter) Validate() error {
+	switch r.format {
+	case DiagnosticsText, DiagnosticsQuickfix, DiagnosticsJSON:
+		return nil
+	}
+	return xerrors.Errorf("unknown build.diagnostics.format %s. it must be text, quickfix or json", r.format)
+}
+
+// Capture returns writer for stderr of one command.
+func (r *DiagnosticReporter) Capture() *DiagnosticCapture {
+	return &DiagnosticCapture{reporter: r}
+}
+
+func (r *DiagnosticReporter) write(text string) {
+	if text == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprint(r.w, text)
+	r.report.WriteString(text)
+}
+
+func (r *DiagnosticReporter) formatDiagnostics(diagnostics []*Diagnostic) string {
+	var b strings.Builder
+	for _, d := range diagnostics {
+		if r.format == DiagnosticsJSON {
+			line, err := json.Marshal(d)
+			if err != nil {
+				continue
+			}
+			b.Write(line)
+			b.WriteByte('\n')
+			continue
+		}
+		b.WriteString(d.Quickfix())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Flush writes the report since the last Flush to `build.diagnostics.output`.
+// The file becomes empty when the build succeeded without any output.
+func (r *DiagnosticReporter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.report.Bytes()
+	r.report.Reset()
+	if r.output == "" {
+		return nil
+	}
+	output := ExpandPath(r.output)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return xerrors.Errorf("failed to create directory for %s: %w", output, err)
+	}
+	if err := ioutil.WriteFile(output, report, 0644); err != nil {
+		return xerrors.Errorf("failed to write diagnostics to %s: %w", output, err)
+	}
+	return nil
+}
+
+// DiagnosticCapture buffers stderr of the command by lines and rewrites paths.
+// With text format, lines are reported as soon as written. Otherwise, they are reported by Finish.
+type DiagnosticCapture struct {
+	reporter *DiagnosticReporter
+	mu       sync.Mutex
+	line     []byte
+	output   bytes.Buffer
+}
+
+func (c *DiagnosticCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.line = append(c.line, p...)
+	for {
+		idx := bytes.IndexByte(c.line, '\n')
+		if idx < 0 {
+			break
+		}
+		c.writeLine(string(c.line[:idx+1]))
+		c.line = c.line[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (c *DiagnosticCapture) writeLine(line string) {
+	line = c.reporter.paths.rewrite(line)
+	c.output.WriteString(line)
+	if c.reporter.format == DiagnosticsText {
+		c.reporter.write(line)
+	}
+}
+
+// Finish reports the captured output, and returns it with parsed diagnostics.
+func (c *DiagnosticCapture) Finish() (string, []*Diagnostic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.line) > 0 {
+		c.writeLine(string(c.line) + "\n")
+		c.line = nil
+	}
+	output := c.output.String()
+	diagnostics := parseDiagnostics(output, c.reporter.paths)
+	if c.reporter.format != DiagnosticsText {
+		c.reporter.write(c.reporter.formatDiagnostics(diagnostics))
+	}
+	return output, diagnostics
+}
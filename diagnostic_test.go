@@ -0,0 +1,108 @@
+package rebirth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	paths := &diagnosticPaths{
+		modulePath: "example.com/app",
+		prefixes:   []string{"/go/src/example.com/app/", "/home/user/app/"},
+	}
+	tests := []struct {
+		name     string
+		output   string
+		expected []*Diagnostic
+	}{
+		{
+			name:   "package line",
+			output: "# example.com/app/server\nserver/server.go:10:2: undefined: foo\nserver/server.go:12: missing return\n",
+			expected: []*Diagnostic{
+				{File: "server/server.go", Line: 10, Column: 2, Message: "undefined: foo", Package: "example.com/app/server"},
+				{File: "server/server.go", Line: 12, Message: "missing return", Package: "example.com/app/server"},
+			},
+		},
+		{
+			name:   "package of file without package line",
+			output: "cmd/api/main.go:3:8: imported and not used: \"fmt\"\n",
+			expected: []*Diagnostic{
+				{File: "cmd/api/main.go", Line: 3, Column: 8, Message: "imported and not used: \"fmt\"", Package: "example.com/app/cmd/api"},
+			},
+		},
+		{
+			name:   "continuation lines",
+			output: "# example.com/app\n./main.go:8:9: cannot use x (type int) as type string in return argument\n\thave (int)\n\twant (string)\n./main.go:9:1: missing return\n",
+			expected: []*Diagnostic{
+				{File: "main.go", Line: 8, Column: 9, Message: "cannot use x (type int) as type string in return argument\nhave (int)\nwant (string)", Package: "example.com/app"},
+				{File: "main.go", Line: 9, Column: 1, Message: "missing return", Package: "example.com/app"},
+			},
+		},
+		{
+			name:   "vet",
+			output: "# example.com/app/server [example.com/app/server.test]\nvet: server/server_test.go:5:2: undeclared name: foo\n",
+			expected: []*Diagnostic{
+				{File: "server/server_test.go", Line: 5, Column: 2, Message: "undeclared name: foo", Package: "example.com/app/server"},
+			},
+		},
+		{
+			name:   "paths under GOPATH symlink",
+			output: "/go/src/example.com/app/server/server.go:1:1: expected 'package', found 'EOF'\n/home/user/app/main.go:2:3: syntax error\n",
+			expected: []*Diagnostic{
+				{File: "server/server.go", Line: 1, Column: 1, Message: "expected 'package', found 'EOF'", Package: "example.com/app/server"},
+				{File: "main.go", Line: 2, Column: 3, Message: "syntax error", Package: "example.com/app"},
+			},
+		},
+		{
+			name:   "windows drive letter",
+			output: "# example.com/app\nC:\\Users\\user\\app\\main.go:4:2: undefined: bar\n",
+			expected: []*Diagnostic{
+				{File: "C:\\Users\\user\\app\\main.go", Line: 4, Column: 2, Message: "undefined: bar", Package: "example.com/app"},
+			},
+		},
+		{
+			name:   "line without position",
+			output: "go: cannot find main module\n\n",
+			expected: []*Diagnostic{
+				{Message: "go: cannot find main module"},
+			},
+		},
+		{
+			name:     "empty",
+			output:   "",
+			expected: []*Diagnostic{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diagnostics := parseDiagnostics(paths.rewrite(test.output), paths)
+			if !reflect.DeepEqual(diagnostics, test.expected) {
+				t.Fatalf("unexpected diagnostics:\nexpected %s\nbut got  %s", formatDiagnosticsForTest(test.expected), formatDiagnosticsForTest(diagnostics))
+			}
+		})
+	}
+}
+
+func TestDiagnosticQuickfix(t *testing.T) {
+	tests := []struct {
+		diagnostic *Diagnostic
+		expected   string
+	}{
+		{diagnostic: &Diagnostic{File: "main.go", Line: 8, Column: 9, Message: "cannot use x\nhave (int)"}, expected: "main.go:8:9: cannot use x have (int)"},
+		{diagnostic: &Diagnostic{File: "main.go", Line: 8, Message: "missing return"}, expected: "main.go:8: missing return"},
+		{diagnostic: &Diagnostic{Message: "go: cannot find main module"}, expected: "go: cannot find main module"},
+	}
+	for _, test := range tests {
+		if quickfix := test.diagnostic.Quickfix(); quickfix != test.expected {
+			t.Fatalf("unexpected quickfix: expected %q but got %q", test.expected, quickfix)
+		}
+	}
+}
+
+func formatDiagnosticsForTest(diagnostics []*Diagnostic) string {
+	formatted := ""
+	for _, d := range diagnostics {
+		formatted += "\n  " + d.Quickfix() + " ( package " + d.Package + " )"
+	}
+	return formatted
+}
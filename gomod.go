@@ -3,16 +3,36 @@ package rebirth
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
-const goModPath = "go.mod"
+const (
+	goModPath = "go.mod"
+	goSumPath = "go.sum"
+)
+
+var vendorModulesPath = filepath.Join("vendor", "modules.txt")
 
 func existsGoMod() bool {
 	_, err := os.Stat(goModPath)
 	return err == nil
 }
 
+// isModuleFile reports whether path is go.mod, go.sum or vendor/modules.txt of the current module.
+func isModuleFile(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, p := range []string{goModPath, goSumPath, vendorModulesPath} {
+		if absPath == filepath.Join(cwd, p) {
+			return true
+		}
+	}
+	return false
+}
+
 var (
 	slashSlash = []byte("//")
 	moduleStr  = []byte("module")
@@ -0,0 +1,93 @@
+package rebirth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func fileHash(path string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// contentHashes keeps content hash of watched files at the last successful build.
+// It is used by only one callback goroutine at a time, so it has no lock.
+type contentHashes struct {
+	hashes map[string]string
+}
+
+func newContentHashes() *contentHashes {
+	return &contentHashes{hashes: map[string]string{}}
+}
+
+func (h *contentHashes) add(path string) {
+	if hash, exists := fileHash(path); exists {
+		h.hashes[path] = hash
+	}
+}
+
+func (h *contentHashes) hasFilesUnder(dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	for path := range h.hashes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupe drops changes that don't change content since the last commit.
+// It returns the number of dropped changes and the hashes to commit after successful build.
+// If the last build failed, unchanged content is kept because the file may be reverted to the content of the last successful build.
+func (h *contentHashes) dedupe(changes *ChangeSet, failed bool) (*ChangeSet, map[string]string) {
+	deduped := &ChangeSet{ChangedAt: changes.ChangedAt}
+	pending := map[string]string{}
+	for _, change := range changes.Changes {
+		prev, existed := h.hashes[change.Path]
+		cur, exists := fileHash(change.Path)
+		switch {
+		case existed && exists && prev == cur && !failed:
+			deduped.Deduplicated++
+			continue
+		case !existed && !exists && !h.hasFilesUnder(change.Path):
+			// temporary file created and removed during the quiet period.
+			deduped.Deduplicated++
+			continue
+		}
+		pending[change.Path] = cur
+		deduped.Changes = append(deduped.Changes, change)
+	}
+	return deduped, pending
+}
+
+func (h *contentHashes) commit(pending map[string]string) {
+	for path, hash := range pending {
+		if hash != "" {
+			h.hashes[path] = hash
+			continue
+		}
+		delete(h.hashes, path)
+		prefix := path + string(filepath.Separator)
+		for p := range h.hashes {
+			if strings.HasPrefix(p, prefix) {
+				delete(h.hashes, p)
+			}
+		}
+	}
+}
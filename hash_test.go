@@ -0,0 +1,92 @@
+package rebirth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+func TestContentHashesDedupe(t *testing.T) {
+	tests := []struct {
+		name         string
+		committed    string // content at the last successful build. empty if the file didn't exist.
+		current      string // content when the change is handled. empty if the file is removed.
+		failed       bool
+		expected     bool
+		deduplicated int
+	}{
+		{name: "unchanged", committed: "a", current: "a", expected: false, deduplicated: 1},
+		{name: "changed", committed: "a", current: "b", expected: true},
+		{name: "created", current: "a", expected: true},
+		{name: "removed", committed: "a", expected: true},
+		{name: "created and removed", expected: false, deduplicated: 1},
+		{name: "reverted after failed build", committed: "a", current: "a", failed: true, expected: true},
+		{name: "changed after failed build", committed: "a", current: "b", failed: true, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rebirth-hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "main.go")
+			hashes := newContentHashes()
+			if test.committed != "" {
+				if err := ioutil.WriteFile(path, []byte(test.committed), 0644); err != nil {
+					t.Fatal(err)
+				}
+				hashes.add(path)
+			}
+			if test.current != "" {
+				if err := ioutil.WriteFile(path, []byte(test.current), 0644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				os.Remove(path)
+			}
+			changes, pending := hashes.dedupe(newChangeSet(map[string]fsnotify.Op{path: fsnotify.Write}), test.failed)
+			expectedPaths := []string{}
+			if test.expected {
+				expectedPaths = []string{path}
+			}
+			if !reflect.DeepEqual(changes.Paths(), expectedPaths) {
+				t.Fatalf("unexpected changes: expected %v but got %v", expectedPaths, changes.Paths())
+			}
+			if changes.Deduplicated != test.deduplicated {
+				t.Fatalf("unexpected number of deduplicated changes: expected %d but got %d", test.deduplicated, changes.Deduplicated)
+			}
+			if _, exists := pending[path]; exists != test.expected {
+				t.Fatalf("hash of the change should be committed only if it's not deduplicated")
+			}
+		})
+	}
+}
+
+func TestContentHashesCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebirth-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(sub, "main.go")
+	if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashes := newContentHashes()
+	hashes.add(path)
+
+	// the removed directory drops hashes of files under it.
+	hashes.commit(map[string]string{sub: ""})
+	if hashes.hasFilesUnder(sub) {
+		t.Fatal("hashes under the removed directory should be deleted")
+	}
+}
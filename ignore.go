@@ -0,0 +1,129 @@
+package rebirth
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const gitignoreFile = ".gitignore"
+
+// ignoreRule is a rule written by gitignore format.
+type ignoreRule struct {
+	pattern *pattern
+	negate  bool
+	dirOnly bool
+}
+
+func parseIgnoreRule(line string) *ignoreRule {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	rule := &ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// escaped `#` or `!`
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	rule.pattern = newPattern(line)
+	return rule
+}
+
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.pattern.match(relPath)
+}
+
+// ignoreMatcher decides ignored paths by .gitignore files under the watch root and `watch.ignore` patterns.
+// Rules in nested .gitignore override the parent's one like git, and `watch.ignore` overrides all of them.
+type ignoreMatcher struct {
+	gitignores map[string][]*ignoreRule
+	rules      []*ignoreRule
+}
+
+func newIgnoreMatcher(patterns []string) *ignoreMatcher {
+	rules := []*ignoreRule{}
+	for _, p := range patterns {
+		if rule := parseIgnoreRule(p); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return &ignoreMatcher{
+		gitignores: map[string][]*ignoreRule{},
+		rules:      rules,
+	}
+}
+
+// loadGitignore reads .gitignore in the directory. relDir is relative path from the watch root.
+func (m *ignoreMatcher) loadGitignore(root, relDir string) {
+	delete(m.gitignores, relDir)
+	file, err := os.Open(filepath.Join(root, relDir, gitignoreFile))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	rules := []*ignoreRule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule := parseIgnoreRule(scanner.Text()); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) > 0 {
+		m.gitignores[relDir] = rules
+	}
+}
+
+// validate returns error if `watch.ignore` has malformed patterns.
+func (m *ignoreMatcher) validate() error {
+	for _, rule := range m.rules {
+		if err := rule.pattern.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether relPath ( relative path from the watch root ) is ignored.
+func (m *ignoreMatcher) match(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(relPath)
+	ignored := false
+	dir := "."
+	rest := relPath
+	for {
+		for _, rule := range m.gitignores[dir] {
+			if rule.match(rest, isDir) {
+				ignored = !rule.negate
+			}
+		}
+		idx := strings.Index(rest, "/")
+		if idx < 0 {
+			break
+		}
+		if dir == "." {
+			dir = rest[:idx]
+		} else {
+			dir = dir + "/" + rest[:idx]
+		}
+		rest = rest[idx+1:]
+	}
+	for _, rule := range m.rules {
+		if rule.match(relPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
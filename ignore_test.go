@@ -0,0 +1,95 @@
+package rebirth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcherMatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "rebirth-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	gitignores := map[string]string{
+		".":       "# comment\nbuild/\n*.pb.go\n!api.pb.go\ntmp\n\\#draft.go\n",
+		"sub":     "!build/\nlocal.go\n",
+		"sub/gen": "*\n!keep.go\n",
+	}
+	for dir, content := range gitignores {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, dir, gitignoreFile), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newIgnoreMatcher([]string{"vendor/", "**/testdata/**", "!sub/local.go"})
+	for dir := range gitignores {
+		m.loadGitignore(root, dir)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{name: "dir-only rule matches directory", path: "build", isDir: true, expected: true},
+		{name: "dir-only rule doesn't match file", path: "build", expected: false},
+		{name: "dir-only rule at any depth", path: "pkg/build", isDir: true, expected: true},
+		{name: "basename pattern", path: "pkg/user.pb.go", expected: true},
+		{name: "negation", path: "pkg/api.pb.go", expected: false},
+		{name: "rule without slash matches file and directory", path: "tmp", isDir: true, expected: true},
+		{name: "escaped #", path: "#draft.go", expected: true},
+		{name: "comment is not a rule", path: "# comment", expected: false},
+		{name: "nested gitignore overrides parent", path: "sub/build", isDir: true, expected: false},
+		{name: "nested gitignore is relative to its directory", path: "local.go", expected: false},
+		{name: "nested gitignore ignores all files", path: "sub/gen/types.go", expected: true},
+		{name: "nested gitignore negation", path: "sub/gen/keep.go", expected: false},
+		{name: "watch.ignore dir-only rule", path: "vendor", isDir: true, expected: true},
+		{name: "watch.ignore double star", path: "pkg/testdata/fixture.go", expected: true},
+		{name: "watch.ignore overrides gitignore", path: "sub/local.go", expected: false},
+		{name: "not ignored", path: "main.go", expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ignored := m.match(test.path, test.isDir); ignored != test.expected {
+				t.Fatalf("unexpected result for %s: expected %v but got %v", test.path, test.expected, ignored)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		isRule  bool
+		negate  bool
+		dirOnly bool
+		pattern string
+	}{
+		{line: "", isRule: false},
+		{line: "# comment", isRule: false},
+		{line: "/", isRule: false},
+		{line: "vendor", isRule: true, pattern: "vendor"},
+		{line: "vendor/  ", isRule: true, dirOnly: true, pattern: "vendor"},
+		{line: "!keep.go", isRule: true, negate: true, pattern: "keep.go"},
+		{line: "!gen/", isRule: true, negate: true, dirOnly: true, pattern: "gen"},
+		{line: `\!important.go`, isRule: true, pattern: "!important.go"},
+	}
+	for _, test := range tests {
+		rule := parseIgnoreRule(test.line)
+		if (rule != nil) != test.isRule {
+			t.Fatalf("unexpected result for %q: rule %v", test.line, rule)
+		}
+		if rule == nil {
+			continue
+		}
+		if rule.negate != test.negate || rule.dirOnly != test.dirOnly || rule.pattern.src != test.pattern {
+			t.Fatalf("unexpected rule for %q: negate %v, dirOnly %v, pattern %s", test.line, rule.negate, rule.dirOnly, rule.pattern.src)
+		}
+	}
+}
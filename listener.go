@@ -0,0 +1,91 @@
+package rebirth
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// listenFDStart is the first file descriptor number passed by socket activation protocol.
+const listenFDStart = 3
+
+// listenPIDScript sets LISTEN_PID to the pid of the application.
+// `exec` keeps the pid of shell, so `$$` becomes the pid of the application.
+const listenPIDScript = `LISTEN_PID=$$; export LISTEN_PID; exec "$0" "$@"`
+
+// socketListeners are listening sockets owned by rebirth.
+// They are passed to each new application as inherited file descriptors by the socket activation protocol
+// ( LISTEN_FDS / LISTEN_PID / LISTEN_FDNAMES ), so connections are queued in the kernel while reloading.
+type socketListeners struct {
+	listeners []net.Listener
+	files     []*os.File
+	names     []string
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+func parseListenAddr(addr string) (string, string) {
+	for _, network := range []string{"tcp4", "tcp6", "tcp", "unix"} {
+		prefix := network + "://"
+		if strings.HasPrefix(addr, prefix) {
+			return network, strings.TrimPrefix(addr, prefix)
+		}
+	}
+	return "tcp", addr
+}
+
+func newSocketListeners(addrs []string) (*socketListeners, error) {
+	l := &socketListeners{}
+	for _, addr := range addrs {
+		network, address := parseListenAddr(addr)
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			l.Close()
+			return nil, xerrors.Errorf("failed to listen %s: %w", addr, err)
+		}
+		l.listeners = append(l.listeners, listener)
+		file, err := listener.(fileListener).File()
+		if err != nil {
+			l.Close()
+			return nil, xerrors.Errorf("failed to get file descriptor of %s: %w", addr, err)
+		}
+		fmt.Printf("Listening %s\n", listener.Addr())
+		l.files = append(l.files, file)
+		// `:` is the separator of LISTEN_FDNAMES.
+		l.names = append(l.names, strings.Replace(addr, ":", "_", -1))
+	}
+	return l, nil
+}
+
+func (l *socketListeners) env() []string {
+	return []string{
+		fmt.Sprintf("LISTEN_FDS=%d", len(l.files)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(l.names, ":")),
+	}
+}
+
+// ports returns TCP port numbers of listening sockets.
+func (l *socketListeners) ports() []int {
+	ports := []int{}
+	for _, listener := range l.listeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			ports = append(ports, addr.Port)
+		}
+	}
+	return ports
+}
+
+func (l *socketListeners) Close() error {
+	for _, file := range l.files {
+		file.Close()
+	}
+	for _, listener := range l.listeners {
+		listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package rebirth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	liveReloadPathPrefix    = "/__rebirth/"
+	liveReloadScriptPath    = "/__rebirth/livereload.js"
+	liveReloadEventsPath    = "/__rebirth/events"
+	liveReloadPingInterval  = 30 * time.Second
+	liveReloadEventReload   = "reload"
+	liveReloadEventCSS      = "css"
+	liveReloadScriptElement = `<script src="/__rebirth/livereload.js"></script>`
+)
+
+// liveReloadScript connects to the events endpoint on the origin of the script.
+// It reloads the page on `reload` event and reloads stylesheets on `css` event.
+const liveReloadScript = `(function() {
+  var script = document.currentScript;
+  var origin = script ? new URL(script.src, location.href).origin : location.origin;
+  var source = new EventSource(origin + '/__rebirth/events');
+  source.addEventListener('reload', function() {
+    location.reload();
+  });
+  source.addEventListener('css', function() {
+    var links = document.querySelectorAll('link[rel="stylesheet"]');
+    for (var i = 0; i < links.length; i++) {
+      var url = new URL(links[i].href, location.href);
+      url.searchParams.set('rebirth', Date.now());
+      links[i].href = url.toString();
+    }
+  });
+})();
+`
+
+type liveReloadEvent struct {
+	name string
+	data string
+}
+
+// liveReloadServer broadcasts reload events to browsers by Server-Sent Events.
+type liveReloadServer struct {
+	listen  string
+	inject  bool
+	mu      sync.Mutex
+	clients map[chan *liveReloadEvent]struct{}
+}
+
+func newLiveReloadServer(cfg *LiveReload) *liveReloadServer {
+	return &liveReloadServer{
+		listen:  cfg.Listen,
+		inject:  cfg.Inject,
+		clients: map[chan *liveReloadEvent]struct{}{},
+	}
+}
+
+func (s *liveReloadServer) ListenAndServe() error {
+	fmt.Printf("LiveReload: %s\n", s.listen)
+	if err := http.ListenAndServe(s.listen, s); err != nil {
+		return xerrors.Errorf("failed to listen %s: %w", s.listen, err)
+	}
+	return nil
+}
+
+func (s *liveReloadServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch req.URL.Path {
+	case liveReloadScriptPath:
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, liveReloadScript)
+	case liveReloadEventsPath:
+		s.serveEvents(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *liveReloadServer) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan *liveReloadEvent, 8)
+	s.mu.Lock()
+	s.clients[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	ping := time.NewTicker(liveReloadPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *liveReloadServer) broadcast(ev *liveReloadEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- ev:
+		default:
+			// the client is too slow. drop the event.
+		}
+	}
+}
+
+// reload makes browsers reload the page.
+func (s *liveReloadServer) reload() {
+	if s == nil {
+		return
+	}
+	s.broadcast(&liveReloadEvent{name: liveReloadEventReload, data: "{}"})
+}
+
+// reloadCSS makes browsers reload stylesheets without reloading the page.
+func (s *liveReloadServer) reloadCSS(paths []string) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		data = []byte("[]")
+	}
+	s.broadcast(&liveReloadEvent{name: liveReloadEventCSS, data: string(data)})
+}
+
+// isInjectable reports whether the script should be injected to the response.
+func (s *liveReloadServer) isInjectable(res *http.Response) bool {
+	if s == nil || !s.inject {
+		return false
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "text/html")
+}
+
+// injectResponse inserts the client script into html response.
+func (s *liveReloadServer) injectResponse(res *http.Response) error {
+	if !s.isInjectable(res) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return xerrors.Errorf("failed to read response body: %w", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		return xerrors.Errorf("failed to close response body: %w", err)
+	}
+	body = injectLiveReloadScript(body)
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// injectLiveReloadScript inserts the client script before `</body>`, or appends it if not found.
+func injectLiveReloadScript(body []byte) []byte {
+	idx := lastIndexASCIIFold(body, []byte("</body>"))
+	if idx < 0 {
+		return append(body, liveReloadScriptElement...)
+	}
+	injected := make([]byte, 0, len(body)+len(liveReloadScriptElement))
+	injected = append(injected, body[:idx]...)
+	injected = append(injected, liveReloadScriptElement...)
+	injected = append(injected, body[idx:]...)
+	return injected
+}
+
+// lastIndexASCIIFold returns the index of the last instance of lower-case sep in s ignoring ASCII case.
+// Unlike bytes.ToLower, it doesn't change the byte length of non-ASCII characters, so the index is valid for s.
+func lastIndexASCIIFold(s, sep []byte) int {
+	for i := len(s) - len(sep); i >= 0; i-- {
+		matched := true
+		for j, c := range s[i : i+len(sep)] {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != sep[j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
+
+// isCSSOnly reports whether all changed files are stylesheets.
+func isCSSOnly(paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	for _, path := range paths {
+		if filepath.Ext(path) != ".css" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package rebirth
+
+import (
+	"testing"
+)
+
+func TestInjectLiveReloadScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "before body", body: "<body>hi</body>", expected: "<body>hi" + liveReloadScriptElement + "</body>"},
+		{name: "upper case", body: "<BODY>hi</BODY>", expected: "<BODY>hi" + liveReloadScriptElement + "</BODY>"},
+		{name: "last body", body: "<body>`</body>`</body>", expected: "<body>`</body>`" + liveReloadScriptElement + "</body>"},
+		{name: "non-ASCII text", body: "<body>İİİİ</BODY>", expected: "<body>İİİİ" + liveReloadScriptElement + "</BODY>"},
+		{name: "without body", body: "hi", expected: "hi" + liveReloadScriptElement},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			injected := string(injectLiveReloadScript([]byte(test.body)))
+			if injected != test.expected {
+				t.Fatalf("unexpected body: expected %q but got %q", test.expected, injected)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package rebirth
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// pattern is a glob pattern for matching paths under the watch root.
+// A pattern without slash matches the base name at any depth ( e.g. `*.go` ).
+// Otherwise, it is matched against the whole relative path and `**` matches zero or more directories.
+type pattern struct {
+	src      string
+	segments []string
+	basename bool
+}
+
+func newPattern(src string) *pattern {
+	p := filepath.ToSlash(src)
+	p = strings.TrimPrefix(p, "./")
+	if !strings.Contains(p, "/") {
+		return &pattern{src: src, segments: []string{p}, basename: true}
+	}
+	return &pattern{src: src, segments: strings.Split(strings.TrimPrefix(p, "/"), "/")}
+}
+
+func newPatterns(srcs []string) []*pattern {
+	patterns := make([]*pattern, 0, len(srcs))
+	for _, src := range srcs {
+		if src == "" {
+			continue
+		}
+		patterns = append(patterns, newPattern(src))
+	}
+	return patterns
+}
+
+// validate returns error if the pattern is malformed. Otherwise, match would never report it.
+func (p *pattern) validate() error {
+	for _, segment := range p.segments {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return xerrors.Errorf("invalid pattern %s: %w", p.src, err)
+		}
+	}
+	return nil
+}
+
+func validatePatterns(patterns []*pattern) error {
+	for _, p := range patterns {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether relative path matches the pattern.
+func (p *pattern) match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	if p.basename {
+		matched, _ := path.Match(p.segments[0], path.Base(relPath))
+		return matched
+	}
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			rest := patterns[1:]
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(rest, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		matched, err := path.Match(patterns[0], names[0])
+		if err != nil || !matched {
+			return false
+		}
+		patterns = patterns[1:]
+		names = names[1:]
+	}
+	return len(names) == 0
+}
+
+func matchAny(patterns []*pattern, relPath string) bool {
+	for _, p := range patterns {
+		if p.match(relPath) {
+			return true
+		}
+	}
+	return false
+}
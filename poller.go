@@ -0,0 +1,178 @@
+package rebirth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+type watchBackend interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+type notifyBackend struct {
+	*fsnotify.Watcher
+}
+
+func newNotifyBackend() (*notifyBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &notifyBackend{Watcher: watcher}, nil
+}
+
+func (b *notifyBackend) Events() <-chan fsnotify.Event {
+	return b.Watcher.Events
+}
+
+func (b *notifyBackend) Errors() <-chan error {
+	return b.Watcher.Errors
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// pollBackend detects changes by scanning stat of the watching directories periodically.
+// It is used for file systems that don't deliver inotify/kqueue events ( e.g. bind mounts on Docker Desktop, NFS, sshfs ).
+type pollBackend struct {
+	interval time.Duration
+	dirs     map[string]map[string]fileStat
+	mu       sync.Mutex
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+}
+
+const defaultPollInterval = 1 * time.Second
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	b := &pollBackend{
+		interval: interval,
+		dirs:     map[string]map[string]fileStat{},
+		events:   make(chan fsnotify.Event, 128),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *pollBackend) Add(path string) error {
+	stats, err := b.scan(path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dirs[path] = stats
+	return nil
+}
+
+func (b *pollBackend) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.dirs, path)
+	return nil
+}
+
+func (b *pollBackend) Events() <-chan fsnotify.Event {
+	return b.events
+}
+
+func (b *pollBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *pollBackend) Close() error {
+	close(b.done)
+	return nil
+}
+
+func (b *pollBackend) scan(dir string) (map[string]fileStat, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]fileStat, len(infos))
+	for _, info := range infos {
+		stats[filepath.Join(dir, info.Name())] = fileStat{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			mode:    info.Mode(),
+		}
+	}
+	return stats, nil
+}
+
+func (b *pollBackend) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			for _, event := range b.poll() {
+				select {
+				case b.events <- event:
+				case <-b.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *pollBackend) poll() []fsnotify.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := []fsnotify.Event{}
+	for dir, prev := range b.dirs {
+		cur, err := b.scan(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed directory is notified by scanning the parent directory.
+				delete(b.dirs, dir)
+				continue
+			}
+			select {
+			case b.errors <- err:
+			default:
+			}
+			continue
+		}
+		for path, stat := range cur {
+			prevStat, exists := prev[path]
+			switch {
+			case !exists:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case stat.mode.IsDir():
+				// modification time of directory is changed by adding or removing its entries.
+			case !stat.modTime.Equal(prevStat.modTime) || stat.size != prevStat.size:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			}
+		}
+		for path := range prev {
+			if _, exists := cur[path]; !exists {
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+			}
+		}
+		b.dirs[dir] = cur
+	}
+	return events
+}
@@ -0,0 +1,37 @@
+package rebirth
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultPortTimeout = 10 * time.Second
+	portCheckInterval  = 100 * time.Millisecond
+)
+
+func isPortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// waitForPorts waits until all ports can be listened.
+func waitForPorts(ports []int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, port := range ports {
+		for !isPortFree(port) {
+			if time.Now().After(deadline) {
+				return xerrors.Errorf("port %d is still in use after waiting %s. the previous process or another process may be using it", port, timeout)
+			}
+			time.Sleep(portCheckInterval)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package rebirth
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/mitchellh/go-ps"
+	"golang.org/x/xerrors"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends signal to all processes in the process group.
+func signalProcessGroup(pgid int, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return xerrors.Errorf("unsupported signal %s", sig)
+	}
+	if err := syscall.Kill(-pgid, s); err != nil {
+		if err == syscall.ESRCH {
+			return nil
+		}
+		return xerrors.Errorf("failed to send %s to process group %d: %w", sig, pgid, err)
+	}
+	return nil
+}
+
+// processGroupMembers returns alive processes in the process group.
+func processGroupMembers(pgid int) []ps.Process {
+	processes, err := ps.Processes()
+	if err != nil {
+		return nil
+	}
+	members := []ps.Process{}
+	for _, process := range processes {
+		id, err := syscall.Getpgid(process.Pid())
+		if err != nil || id != pgid {
+			continue
+		}
+		members = append(members, process)
+	}
+	return members
+}
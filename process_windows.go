@@ -0,0 +1,27 @@
+package rebirth
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/mitchellh/go-ps"
+	"golang.org/x/xerrors"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup sends signal to the process only because process group is not supported on Windows.
+func signalProcessGroup(pgid int, sig os.Signal) error {
+	process, err := os.FindProcess(pgid)
+	if err != nil {
+		return xerrors.Errorf("failed to find process %d: %w", pgid, err)
+	}
+	if err := process.Signal(sig); err != nil {
+		return xerrors.Errorf("failed to send %s to process %d: %w", sig, pgid, err)
+	}
+	return nil
+}
+
+func processGroupMembers(pgid int) []ps.Process {
+	return nil
+}
@@ -0,0 +1,235 @@
+package rebirth
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultProxyTimeout = 30 * time.Second
+	proxyDialInterval   = 100 * time.Millisecond
+)
+
+type proxyState int
+
+const (
+	proxyStateBuilding proxyState = iota
+	proxyStateRestarting
+	proxyStateReady
+	proxyStateFailed
+)
+
+// proxyServer forwards requests to the application.
+// While building or restarting the application, requests are held until the new process accepts connections.
+// If building failed, the compiler output is returned instead.
+type proxyServer struct {
+	listen      string
+	target      *url.URL
+	timeout     time.Duration
+	proxy       *httputil.ReverseProxy
+	mu          sync.Mutex
+	state       proxyState
+	output      string
+	diagnostics []*Diagnostic
+	changed     chan struct{}
+	gen         int
+	liveReload  *liveReloadServer
+}
+
+func newProxyServer(cfg *Proxy, liveReload *liveReloadServer) (*proxyServer, error) {
+	if cfg.Listen == "" {
+		return nil, xerrors.New("proxy.listen is required")
+	}
+	if cfg.Target == "" {
+		return nil, xerrors.New("proxy.target is required")
+	}
+	target := cfg.Target
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse proxy.target %s: %w", cfg.Target, err)
+	}
+	timeout := defaultProxyTimeout
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout.Duration()
+	}
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if liveReload != nil && liveReload.inject {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			// compressed html can't be injected the script.
+			req.Header.Del("Accept-Encoding")
+		}
+		proxy.ModifyResponse = liveReload.injectResponse
+	}
+	return &proxyServer{
+		listen:     cfg.Listen,
+		target:     targetURL,
+		timeout:    timeout,
+		proxy:      proxy,
+		state:      proxyStateBuilding,
+		changed:    make(chan struct{}),
+		liveReload: liveReload,
+	}, nil
+}
+
+func (p *proxyServer) ListenAndServe() error {
+	fmt.Printf("Proxy: %s -> %s\n", p.listen, p.target)
+	if err := http.ListenAndServe(p.listen, p); err != nil {
+		return xerrors.Errorf("failed to listen %s: %w", p.listen, err)
+	}
+	return nil
+}
+
+func (p *proxyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if p.liveReload != nil && strings.HasPrefix(req.URL.Path, liveReloadPathPrefix) {
+		p.liveReload.ServeHTTP(w, req)
+		return
+	}
+	state, output := p.waitForReady(req)
+	switch state {
+	case proxyStateReady:
+		p.proxy.ServeHTTP(w, req)
+	case proxyStateFailed:
+		p.writeBuildError(w, req, output)
+	default:
+		http.Error(w, "rebirth: timeout waiting for the application", http.StatusGatewayTimeout)
+	}
+}
+
+func (p *proxyServer) waitForReady(req *http.Request) (proxyState, string) {
+	timeout := time.After(p.timeout)
+	for {
+		p.mu.Lock()
+		state, output, changed := p.state, p.output, p.changed
+		p.mu.Unlock()
+		if state == proxyStateReady || state == proxyStateFailed {
+			return state, output
+		}
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return state, output
+		case <-timeout:
+			return state, output
+		}
+	}
+}
+
+func (p *proxyServer) writeBuildError(w http.ResponseWriter, req *http.Request, output string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		p.mu.Lock()
+		diagnostics := p.diagnostics
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "build failed",
+			"output":      output,
+			"diagnostics": diagnostics,
+		}); err != nil {
+			log.Printf("%+v", xerrors.Errorf("failed to write build error: %w", err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	page := []byte(fmt.Sprintf(buildErrorHTML, html.EscapeString(output)))
+	if p.liveReload != nil && p.liveReload.inject {
+		page = injectLiveReloadScript(page)
+	}
+	if _, err := w.Write(page); err != nil {
+		log.Printf("%+v", xerrors.Errorf("failed to write build error: %w", err))
+	}
+}
+
+const buildErrorHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>rebirth: build failed</title></head>
+<body style="font-family: sans-serif; margin: 2em;">
+<h1 style="color: #c00;">Build failed</h1>
+<pre style="background: #f5f5f5; padding: 1em; overflow: auto;">%s</pre>
+</body>
+</html>
+`
+
+func (p *proxyServer) setState(state proxyState, output string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setStateLocked(state, output)
+}
+
+func (p *proxyServer) setStateLocked(state proxyState, output string) int {
+	p.state = state
+	p.output = output
+	p.gen++
+	close(p.changed)
+	p.changed = make(chan struct{})
+	if state == proxyStateReady || state == proxyStateFailed {
+		// shows the new application or the build error on browsers.
+		p.liveReload.reload()
+	}
+	return p.gen
+}
+
+// building holds requests until the application is restarted.
+func (p *proxyServer) building() {
+	if p == nil {
+		return
+	}
+	p.setState(proxyStateBuilding, "")
+}
+
+// failed responds requests with build output until the next build.
+func (p *proxyServer) failed(output string, diagnostics []*Diagnostic) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.diagnostics = diagnostics
+	p.setStateLocked(proxyStateFailed, output)
+}
+
+// restarted holds requests until the new process accepts connections.
+func (p *proxyServer) restarted() {
+	if p == nil {
+		return
+	}
+	gen := p.setState(proxyStateRestarting, "")
+	go p.waitForTarget(gen)
+}
+
+func (p *proxyServer) waitForTarget(gen int) {
+	deadline := time.Now().Add(p.timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", p.target.Host, proxyDialInterval)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(proxyDialInterval)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gen != gen {
+		// building or restarting again while waiting.
+		return
+	}
+	p.setStateLocked(proxyStateReady, "")
+}
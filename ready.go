@@ -0,0 +1,180 @@
+package rebirth
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultReadyTimeout = 30 * time.Second
+	readyCheckInterval  = 100 * time.Millisecond
+)
+
+type readyCheck struct {
+	cfg        *ReadyCheck
+	log        *regexp.Regexp
+	logMatched chan struct{}
+	once       sync.Once
+}
+
+func (c *readyCheck) String() string {
+	switch {
+	case c.cfg.TCP != "":
+		return fmt.Sprintf("tcp %s", c.cfg.TCP)
+	case c.cfg.HTTP != "":
+		return fmt.Sprintf("http %s", c.cfg.HTTP)
+	default:
+		return fmt.Sprintf("log %s", c.cfg.Log)
+	}
+}
+
+func (c *readyCheck) timeout() time.Duration {
+	if c.cfg.Timeout > 0 {
+		return c.cfg.Timeout.Duration()
+	}
+	return defaultReadyTimeout
+}
+
+func (c *readyCheck) status() int {
+	if c.cfg.Status != 0 {
+		return c.cfg.Status
+	}
+	return http.StatusOK
+}
+
+// readinessProbe waits until the started process becomes ready by `run.ready` checks.
+// Checks are done in order, and each check has its own timeout.
+type readinessProbe struct {
+	checks []*readyCheck
+}
+
+func newReadinessProbe(cfgs []*ReadyCheck) (*readinessProbe, error) {
+	checks := make([]*readyCheck, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		check := &readyCheck{cfg: cfg}
+		switch {
+		case cfg.TCP != "", cfg.HTTP != "":
+		case cfg.Log != "":
+			re, err := regexp.Compile(cfg.Log)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to compile log pattern %s: %w", cfg.Log, err)
+			}
+			check.log = re
+			check.logMatched = make(chan struct{})
+		default:
+			return nil, xerrors.New("run.ready requires tcp, http or log")
+		}
+		checks = append(checks, check)
+	}
+	return &readinessProbe{checks: checks}, nil
+}
+
+func (p *readinessProbe) hasLogChecks() bool {
+	for _, check := range p.checks {
+		if check.log != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// logWriter returns writer for matching output lines of the process with log checks.
+// It should be used for each output stream, because incomplete line is buffered.
+func (p *readinessProbe) logWriter() *readyLogWriter {
+	return &readyLogWriter{probe: p}
+}
+
+func (p *readinessProbe) matchLine(line []byte) {
+	for _, check := range p.checks {
+		if check.log == nil || !check.log.Match(line) {
+			continue
+		}
+		check.once.Do(func() {
+			close(check.logMatched)
+		})
+	}
+}
+
+// wait waits for all checks. exited is closed when the process exited.
+func (p *readinessProbe) wait(exited <-chan struct{}) error {
+	for _, check := range p.checks {
+		if err := p.waitCheck(check, exited); err != nil {
+			return xerrors.Errorf("%s: %w", check, err)
+		}
+	}
+	return nil
+}
+
+func (p *readinessProbe) waitCheck(check *readyCheck, exited <-chan struct{}) error {
+	timeout := time.After(check.timeout())
+	var lastErr error
+	for {
+		if check.log == nil {
+			lastErr = p.try(check)
+			if lastErr == nil {
+				return nil
+			}
+		}
+		select {
+		case <-check.logMatched:
+			return nil
+		case <-exited:
+			return xerrors.New("process exited before ready")
+		case <-timeout:
+			if lastErr != nil {
+				return xerrors.Errorf("not ready in %s: %w", check.timeout(), lastErr)
+			}
+			return xerrors.Errorf("not ready in %s", check.timeout())
+		case <-time.After(readyCheckInterval):
+		}
+	}
+}
+
+func (p *readinessProbe) try(check *readyCheck) error {
+	if check.cfg.TCP != "" {
+		conn, err := net.DialTimeout("tcp", check.cfg.TCP, time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	client := &http.Client{Timeout: time.Second}
+	res, err := client.Get(check.cfg.HTTP)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != check.status() {
+		return xerrors.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+type readyLogWriter struct {
+	probe *readinessProbe
+	mu    sync.Mutex
+	line  []byte
+}
+
+func (w *readyLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.line = append(w.line, p...)
+	for {
+		idx := bytes.IndexByte(w.line, '\n')
+		if idx < 0 {
+			break
+		}
+		w.probe.matchLine(w.line[:idx])
+		w.line = w.line[idx+1:]
+	}
+	return len(p), nil
+}
@@ -1,7 +1,9 @@
 package rebirth
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,96 +22,353 @@ import (
 var (
 	cwd               string
 	configDir         string
-	buildPath         string
-	pidPath           string
 	dockerRebirthPath string
 	binPath           string
 	pkgPath           string
+	changedFilesPath  string
 )
 
 func init() {
 	cwd, _ = os.Getwd()
 	configDir = ".rebirth"
-	buildPath = filepath.Join(cwd, configDir, "program")
-	pidPath = filepath.Join(configDir, "server.pid")
 	dockerRebirthPath = filepath.Join(configDir, "__rebirth")
 	binPath = filepath.Join(configDir, "bin")
 	pkgPath = filepath.Join(configDir, "pkg")
+	changedFilesPath = filepath.Join(cwd, configDir, "changed_files")
 }
 
+const (
+	defaultReloadedTimeout = 30 * time.Second
+	reloadedCheckInterval  = 100 * time.Millisecond
+)
+
 type Reloader struct {
-	host  *Host
-	cmd   *Command
-	build *Build
-	run   *Run
+	name          string
+	prefix        string
+	buildPath     string
+	pidPath       string
+	changedAtPath string
+	reloadedPath  string
+	requestPath   string
+	artifacts     *artifactStore
+	host          *Host
+	cmd           *Command
+	build         *Build
+	run           *Run
+	tasks         map[string]*Task
+	rules         *actionRules
+	deps          *depGraph
+	mu            sync.Mutex
+	retries       int
+	listeners     *socketListeners
+	proxyCfg      *Proxy
+	proxy         *proxyServer
+	liveReloadCfg *LiveReload
+	liveReload    *liveReloadServer
+	changedAt     time.Time
+	diagnostics   *DiagnosticReporter
+	isBuildFailed bool
+	reloadGen     int
 }
 
 func NewReloader(cfg *Config) *Reloader {
-	return &Reloader{
-		host:  cfg.Host,
-		build: cfg.Build,
-		run:   cfg.Run,
+	return newReloader("", "", cfg)
+}
+
+// newReloader creates Reloader for the process. Artifacts of the named process are put to `.rebirth/<name>`.
+func newReloader(name, prefix string, cfg *Config) *Reloader {
+	dir := configDir
+	if name != "" {
+		dir = filepath.Join(configDir, name)
+	}
+	r := &Reloader{
+		name:          name,
+		prefix:        prefix,
+		buildPath:     filepath.Join(cwd, dir, "program"),
+		pidPath:       filepath.Join(dir, "server.pid"),
+		changedAtPath: filepath.Join(dir, "changed_at"),
+		reloadedPath:  filepath.Join(dir, "reloaded"),
+		requestPath:   filepath.Join(dir, "reload"),
+		host:          cfg.Host,
+		build:         cfg.Build,
+		run:           cfg.Run,
+		tasks:         cfg.Task,
+		rules:         newActionRules(cfg.Watch),
+		proxyCfg:      cfg.Proxy,
+		liveReloadCfg: cfg.LiveReload,
+	}
+	history := 0
+	var diagnostics *Diagnostics
+	if cfg.Build != nil {
+		history = cfg.Build.History
+		diagnostics = cfg.Build.Diagnostics
 	}
+	r.diagnostics = NewDiagnosticReporter(diagnostics)
+	r.artifacts = newArtifactStore(filepath.Join(cwd, dir), r.buildPath, history)
+	if name != "" || (cfg.Watch != nil && cfg.Watch.DepsOnly) {
+		// named processes are rebuilt only when the changed files affect them.
+		r.deps = newDepGraph(r.mainPackage(), r.goCommand())
+	}
+	return r
 }
 
-func (r *Reloader) xbuildMain(path string) error {
-	mainPkgPath := "."
+func (r *Reloader) mainPackage() string {
 	if r.build != nil && r.build.Main != "" {
-		mainPkgPath = r.build.Main
+		return r.build.Main
+	}
+	return "."
+}
+
+// xbuildMain builds main package as the next generation, and swaps the program to it on success.
+func (r *Reloader) xbuildMain(ctx context.Context, changes *ChangeSet) error {
+	a, err := r.artifacts.next(r.mainPackage())
+	if err != nil {
+		return xerrors.Errorf("failed to prepare artifact: %w", err)
 	}
-	if err := r.xbuild(path, mainPkgPath); err != nil {
+	err = r.xbuild(ctx, a.programPath(), r.mainPackage(), changes)
+	if err := r.diagnostics.Flush(); err != nil {
+		log.Printf("%+v", xerrors.Errorf("failed to write diagnostics: %w", err))
+	}
+	if err != nil {
+		r.artifacts.discard(a)
 		return xerrors.Errorf("failed to build on host: %w", err)
 	}
+	if err := r.artifacts.commit(a); err != nil {
+		return xerrors.Errorf("failed to commit artifact: %w", err)
+	}
+	r.setBuildFailed(false)
+	fmt.Printf("Built%s: %s\n", r.nameSuffix(), a)
+	return nil
+}
+
+// Rollback swaps the program to the artifact of the generation and restarts the running rebirth.
+// The previous generation is used if generation is zero.
+func (r *Reloader) Rollback(generation int) error {
+	if generation == 0 {
+		gen, err := r.artifacts.previous()
+		if err != nil {
+			return xerrors.Errorf("failed to find previous generation: %w", err)
+		}
+		generation = gen
+	}
+	a, err := r.artifacts.load(generation)
+	if err != nil {
+		gens, _ := r.artifacts.generations()
+		return xerrors.Errorf("failed to load generation %d ( available: %v ): %w", generation, gens, err)
+	}
+	if err := r.artifacts.swap(a); err != nil {
+		return xerrors.Errorf("failed to swap program: %w", err)
+	}
+	fmt.Printf("Rollback%s to %s\n", r.nameSuffix(), a)
+	pid, err := r.readPID()
+	if err != nil {
+		return xerrors.Errorf("failed to read pid of running rebirth: %w", err)
+	}
+	if err := r.requestReload(); err != nil {
+		return xerrors.Errorf("failed to request reloading: %w", err)
+	}
+	if r.isUsedDocker() {
+		if err := NewDockerCommand(r.host.Docker, "kill", "-HUP", fmt.Sprint(pid)).Run(); err != nil {
+			return xerrors.Errorf("failed to exec command on docker container: %w", err)
+		}
+		return nil
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return xerrors.Errorf("failed to find process by pid(%d): %w", pid, err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		return xerrors.Errorf("failed to send SIGHUP to rebirth: %w", err)
+	}
 	return nil
 }
 
 func (r *Reloader) Run() error {
+	if r.isUsedDocker() && !r.isOnDockerContainer() {
+		if err := r.xbuildRebirth(); err != nil {
+			return xerrors.Errorf("failed to cross compile for rebirth: %w", err)
+		}
+	}
+	if err := r.start(); err != nil {
+		return xerrors.Errorf("failed to start: %w", err)
+	}
+	for {
+		time.Sleep(1 * time.Second)
+	}
+	return nil
+}
+
+// start builds and starts the process, and returns without waiting for its exit.
+func (r *Reloader) start() error {
+	if err := r.diagnostics.Validate(); err != nil {
+		return xerrors.Errorf("invalid build.diagnostics: %w", err)
+	}
 	if !r.IsEnabledReload() {
 		if err := r.writePID(); err != nil {
 			return xerrors.Errorf("failed to write pid: %w", err)
 		}
-		if err := r.reload(); err != nil {
-			return xerrors.Errorf("failed to reload: %w", err)
+		if _, err := os.Stat(r.buildPath); err != nil {
+			// the first build on the docker host is failed.
+			fmt.Println("Waiting for the program to be built...")
+		} else if err := r.reload(); err != nil {
+			// keep watching reloading signal to start the program built by the next change.
+			r.writeReloaded(err)
+			log.Printf("%+v", xerrors.Errorf("failed to reload: %w", err))
 		}
 	} else if r.isUsedDocker() && !r.isOnDockerContainer() {
-		if err := r.xbuildRebirth(); err != nil {
-			return xerrors.Errorf("failed to cross compile for rebirth: %w", err)
+		if err := r.startServers(); err != nil {
+			return xerrors.Errorf("failed to start servers: %w", err)
 		}
 		if err := r.runBuildInitCommands(); err != nil {
 			return xerrors.Errorf("failed to build.init commands: %w", err)
 		}
-		if err := r.xbuildMain(buildPath); err != nil {
-			log.Println(xerrors.Errorf("failed to build main: %w", err))
+		gen := r.nextReloadGen()
+		buildErr := r.xbuildMain(context.Background(), nil)
+		if buildErr != nil {
+			r.buildFailed(buildErr)
+			log.Println(xerrors.Errorf("failed to build main: %w", buildErr))
+		}
+		os.Remove(r.reloadedPath)
+		args := []string{dockerRebirthPath}
+		if r.name != "" {
+			args = append(args, "watch", r.name)
+		}
+		dockerCmd := NewDockerCommand(r.host.Docker, args...)
+		if r.isStdinInherited() {
+			dockerCmd.SetStdin(os.Stdin)
+		}
+		go dockerCmd.Run()
+		if buildErr == nil {
+			r.watchContainerReady(gen)
 		}
-		go NewDockerCommand(r.host.Docker, dockerRebirthPath).Run()
 	} else {
 		// running reloader on localhost
+		if err := r.writePID(); err != nil {
+			return xerrors.Errorf("failed to write pid: %w", err)
+		}
+		if err := r.startServers(); err != nil {
+			return xerrors.Errorf("failed to start servers: %w", err)
+		}
 		if err := r.runBuildInitCommands(); err != nil {
 			return xerrors.Errorf("failed to build.init commands: %w", err)
 		}
-		if err := r.xbuildMain(buildPath); err != nil {
+		if err := r.xbuildMain(context.Background(), nil); err != nil {
+			// the process is started by the next change that fixes the build.
+			r.buildFailed(err)
 			log.Println(xerrors.Errorf("failed to build main: %w", err))
-		}
-		if err := r.reload(); err != nil {
-			return xerrors.Errorf("failed to reload: %w", err)
+		} else if err := r.reload(); err != nil {
+			// keep watching to start the process by the next change.
+			log.Printf("%+v", xerrors.Errorf("failed to reload: %w", err))
 		}
 	}
 	r.watchReloadSignal()
-	for {
-		time.Sleep(1 * time.Second)
+	return nil
+}
+
+// startServers starts `live_reload` and `proxy` servers if they are configured.
+func (r *Reloader) startServers() error {
+	if r.liveReloadCfg != nil {
+		if r.liveReloadCfg.Listen == "" && r.proxyCfg == nil {
+			return xerrors.New("live_reload requires live_reload.listen or proxy")
+		}
+		if r.liveReloadCfg.Inject && r.proxyCfg == nil {
+			return xerrors.New("live_reload.inject requires proxy")
+		}
+		r.liveReload = newLiveReloadServer(r.liveReloadCfg)
+		if r.liveReloadCfg.Listen != "" {
+			go func() {
+				if err := r.liveReload.ListenAndServe(); err != nil {
+					log.Printf("%+v", err)
+				}
+			}()
+		}
+	}
+	if r.proxyCfg != nil {
+		proxy, err := newProxyServer(r.proxyCfg, r.liveReload)
+		if err != nil {
+			return xerrors.Errorf("failed to create proxy: %w", err)
+		}
+		r.proxy = proxy
+		go func() {
+			if err := proxy.ListenAndServe(); err != nil {
+				log.Printf("%+v", err)
+			}
+		}()
 	}
 	return nil
 }
 
-func (r *Reloader) runBuildHookCommandInGoContext(cmd string) error {
+// ready notifies that the new process passed `run.ready` checks.
+// Browsers are reloaded after the proxy confirmed the process accepts connections, or immediately without proxy.
+// While the last build is failed, the proxy keeps showing the build error for the previous process.
+func (r *Reloader) ready() {
+	r.mu.Lock()
+	isBuildFailed := r.isBuildFailed
+	r.mu.Unlock()
+	if isBuildFailed {
+		return
+	}
+	if r.proxy != nil {
+		r.proxy.restarted()
+		return
+	}
+	r.liveReload.reload()
+}
+
+// restarting holds requests to the proxy until the restarted process is ready.
+// While the last build is failed, the proxy keeps showing the build error.
+func (r *Reloader) restarting() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restartingLocked()
+}
+
+func (r *Reloader) restartingLocked() {
+	if r.isBuildFailed {
+		return
+	}
+	r.proxy.building()
+}
+
+// notReady makes proxy respond with the reason why the new process is not ready.
+func (r *Reloader) notReady(reason string) {
+	r.proxy.failed(fmt.Sprintf("reload failed: %s", reason), nil)
+}
+
+func (r *Reloader) setBuildFailed(isBuildFailed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.isBuildFailed = isBuildFailed
+}
+
+// buildFailed makes proxy respond with the compiler output of failed build.
+func (r *Reloader) buildFailed(err error) {
+	r.setBuildFailed(true)
+	var buildErr *BuildError
+	if xerrors.As(err, &buildErr) {
+		r.proxy.failed(buildErr.Output, buildErr.Diagnostics)
+		return
+	}
+	r.proxy.failed(fmt.Sprintf("%v", err), nil)
+}
+
+func (r *Reloader) runBuildHookCommandInGoContext(ctx context.Context, cmd string, changes *ChangeSet) error {
 	gocmd := NewGoCommand()
-	env := []string{}
+	gocmd.SetContext(ctx)
+	env, err := changes.env()
+	if err != nil {
+		return xerrors.Errorf("failed to get env for changed files: %w", err)
+	}
 	for k, v := range r.build.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, ExpandPath(v)))
 	}
 	gocmd.AddEnv(env)
-	if err := gocmd.RunInGoContext(strings.Split(cmd, " ")...); err != nil {
-		return xerrors.Errorf("failed to run command %s: %w", cmd, err)
+	capture := r.diagnostics.Capture()
+	gocmd.SetStderr(capture)
+	err = gocmd.RunInGoContext(strings.Split(cmd, " ")...)
+	output, diagnostics := capture.Finish()
+	if err != nil {
+		return xerrors.Errorf("failed to run command %s: %w", cmd, &BuildError{Output: output, Diagnostics: diagnostics, Err: err})
 	}
 	return nil
 }
@@ -119,33 +379,33 @@ func (r *Reloader) runBuildInitCommands() error {
 	}
 	for _, cmd := range r.build.Init {
 		fmt.Printf("Running: %s\n", cmd)
-		if err := r.runBuildHookCommandInGoContext(cmd); err != nil {
+		if err := r.runBuildHookCommandInGoContext(context.Background(), cmd, nil); err != nil {
 			return xerrors.Errorf("failed to run command in build.init: %w", err)
 		}
 	}
 	return nil
 }
 
-func (r *Reloader) runBuildBeforeCommands() error {
+func (r *Reloader) runBuildBeforeCommands(ctx context.Context, changes *ChangeSet) error {
 	if r.build == nil {
 		return nil
 	}
 	for _, cmd := range r.build.Before {
 		fmt.Printf("Running: %s\n", cmd)
-		if err := r.runBuildHookCommandInGoContext(cmd); err != nil {
+		if err := r.runBuildHookCommandInGoContext(ctx, cmd, changes); err != nil {
 			return xerrors.Errorf("failed to run command in build.before: %w", err)
 		}
 	}
 	return nil
 }
 
-func (r *Reloader) runBuildAfterCommands() error {
+func (r *Reloader) runBuildAfterCommands(ctx context.Context, changes *ChangeSet) error {
 	if r.build == nil {
 		return nil
 	}
 	for _, cmd := range r.build.After {
 		fmt.Printf("Running: %s\n", cmd)
-		if err := r.runBuildHookCommandInGoContext(cmd); err != nil {
+		if err := r.runBuildHookCommandInGoContext(ctx, cmd, changes); err != nil {
 			return xerrors.Errorf("failed to run command in build.after: %w", err)
 		}
 	}
@@ -162,8 +422,16 @@ func (r *Reloader) IsEnabledReload() bool {
 	return false
 }
 
-func (r *Reloader) Reload() error {
-	if err := r.xbuildMain(buildPath); err != nil {
+// Reload builds main package and restarts it. changes is passed to build hooks and can be nil.
+// Building is canceled when ctx is done.
+func (r *Reloader) Reload(ctx context.Context, changes *ChangeSet) error {
+	r.proxy.building()
+	if err := r.xbuildMain(ctx, changes); err != nil {
+		// the process is not restarted, so the time of the change must not be used by the next restart.
+		r.setChangedAt(time.Time{})
+		if ctx.Err() == nil {
+			r.buildFailed(err)
+		}
 		return xerrors.Errorf("failed to build main: %w", err)
 	}
 	if err := r.sendReloadingSignal(); err != nil {
@@ -172,15 +440,313 @@ func (r *Reloader) Reload() error {
 	return nil
 }
 
-func (r *Reloader) Close() error {
-	if !r.isUsedDocker() {
+// Handle runs actions decided by `watch.rules` for changed files.
+func (r *Reloader) Handle(ctx context.Context, changes *ChangeSet) error {
+	fmt.Printf("Changed: %s\n", changes)
+	changes = r.filterChanges(changes)
+	if len(changes.Changes) == 0 {
+		return nil
+	}
+	plan, err := r.plan(changes.Paths())
+	if err != nil {
+		return xerrors.Errorf("failed to decide action: %w", err)
+	}
+	if err := r.prepare(ctx, plan, changes); err != nil {
+		return xerrors.Errorf("failed to prepare: %w", err)
+	}
+	if err := r.apply(ctx, plan, changes); err != nil {
+		return xerrors.Errorf("failed to apply changes: %w", err)
+	}
+	return nil
+}
+
+// handleProcess reloads the process managed by Supervisor. Modules and tasks are already prepared by Supervisor.
+func (r *Reloader) handleProcess(ctx context.Context, changes *ChangeSet) error {
+	changes = r.filterChanges(changes)
+	if len(changes.Changes) == 0 {
+		return nil
+	}
+	plan, err := r.plan(changes.Paths())
+	if err != nil {
+		return xerrors.Errorf("failed to decide action: %w", err)
+	}
+	if err := r.apply(ctx, plan, changes); err != nil {
+		return xerrors.Errorf("failed to apply changes: %w", err)
+	}
+	return nil
+}
+
+// plan decides actions for changed files.
+// With live_reload, stylesheets that don't match any `watch.rules` are reloaded in browsers without rebuild.
+func (r *Reloader) plan(paths []string) (*actionPlan, error) {
+	if r.liveReloadCfg != nil && isCSSOnly(paths) && !r.rules.matchAnyPath(paths) {
+		return &actionPlan{}, nil
+	}
+	return r.rules.plan(paths)
+}
+
+// prepare downloads modules and runs tasks for the plan.
+func (r *Reloader) prepare(ctx context.Context, plan *actionPlan, changes *ChangeSet) error {
+	if plan.modulesChanged {
+		if err := r.downloadModules(); err != nil {
+			return xerrors.Errorf("failed to resolve module dependencies: %w", err)
+		}
+	}
+	for _, task := range plan.tasks {
+		if err := r.runTask(ctx, task, changes); err != nil {
+			return xerrors.Errorf("failed to run task: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply rebuilds or restarts the process for the plan.
+func (r *Reloader) apply(ctx context.Context, plan *actionPlan, changes *ChangeSet) error {
+	if plan.rebuild || plan.restart {
+		r.setChangedAt(changes.ChangedAt)
+	}
+	if plan.rebuild {
+		if err := r.Reload(ctx, changes); err != nil {
+			return xerrors.Errorf("failed to reload: %w", err)
+		}
+		return nil
+	}
+	if plan.restart {
+		if err := r.Restart(); err != nil {
+			return xerrors.Errorf("failed to restart: %w", err)
+		}
+		return nil
+	}
+	if isCSSOnly(changes.Paths()) {
+		r.liveReload.reloadCSS(changes.Paths())
+	}
+	return nil
+}
+
+// setChangedAt records the time of the file change for measuring the time to ready.
+func (r *Reloader) setChangedAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changedAt = t
+}
+
+// writeChangedAt passes the time of the file change to rebirth on the container.
+func (r *Reloader) writeChangedAt() error {
+	r.mu.Lock()
+	changedAt := r.changedAt
+	r.mu.Unlock()
+	if changedAt.IsZero() {
+		return nil
+	}
+	if err := ioutil.WriteFile(r.changedAtPath, []byte(changedAt.Format(time.RFC3339Nano)), 0644); err != nil {
+		return xerrors.Errorf("failed to write %s: %w", r.changedAtPath, err)
+	}
+	return nil
+}
+
+// writeReloaded notifies rebirth on the docker host that the new process is ready or failed to be ready.
+// The file is empty if the process is ready, otherwise it has the reason.
+func (r *Reloader) writeReloaded(reloadErr error) {
+	if !r.isUsedDocker() || !r.isOnDockerContainer() {
+		return
+	}
+	reason := ""
+	if reloadErr != nil {
+		reason = reloadErr.Error()
+	}
+	if err := ioutil.WriteFile(r.reloadedPath, []byte(reason), 0644); err != nil {
+		log.Printf("%+v", xerrors.Errorf("failed to write %s: %w", r.reloadedPath, err))
+	}
+}
+
+// nextReloadGen starts the new generation of reloading on the docker container.
+// It must be called before removing reloadedPath, so that the wait for the previous reloading doesn't read the new result.
+func (r *Reloader) nextReloadGen() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloadGen++
+	return r.reloadGen
+}
+
+func (r *Reloader) isCurrentReloadGen(gen int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadGen == gen
+}
+
+// watchContainerReady notifies proxy and live_reload of the result of reloading on the docker container in the background.
+// Nothing waits for the result without them, and the wait is abandoned when the next reloading starts.
+func (r *Reloader) watchContainerReady(gen int) {
+	if r.proxy == nil && r.liveReload == nil {
+		return
+	}
+	go func() {
+		if err := r.waitForContainerReady(gen); err != nil {
+			r.notReady(err.Error())
+			log.Printf("%+v", err)
+		}
+	}()
+}
+
+// waitForContainerReady waits until rebirth on the container writes reloadedPath, and notifies the result.
+func (r *Reloader) waitForContainerReady(gen int) error {
+	timeout := r.reloadedTimeout()
+	deadline := time.Now().Add(timeout)
+	for r.isCurrentReloadGen(gen) {
+		if reason, err := ioutil.ReadFile(r.reloadedPath); err == nil {
+			if !r.isCurrentReloadGen(gen) {
+				break
+			}
+			if len(reason) > 0 {
+				r.notReady(string(reason))
+				return nil
+			}
+			r.ready()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return xerrors.Errorf("%s is not written in %s", r.reloadedPath, timeout)
+		}
+		time.Sleep(reloadedCheckInterval)
+	}
+	return nil
+}
+
+// reloadedTimeout returns the max duration for stopping the previous process and waiting for `run.ready` checks.
+func (r *Reloader) reloadedTimeout() time.Duration {
+	timeout := defaultReloadedTimeout
+	if r.run == nil {
+		return timeout
+	}
+	for _, check := range r.run.Ready {
+		if check.Timeout > 0 {
+			timeout += check.Timeout.Duration()
+		} else {
+			timeout += defaultReadyTimeout
+		}
+	}
+	return timeout
+}
+
+// requestReload marks the process to be reloaded by the next SIGHUP.
+// All processes of `processes` are run by the same rebirth, so SIGHUP alone can't specify the process.
+func (r *Reloader) requestReload() error {
+	if err := ioutil.WriteFile(r.requestPath, nil, 0644); err != nil {
+		return xerrors.Errorf("failed to write %s: %w", r.requestPath, err)
+	}
+	return nil
+}
+
+// isRequestedReload consumes the mark written by requestReload.
+// The process without name is the only process of rebirth, so it's always reloaded.
+func (r *Reloader) isRequestedReload() bool {
+	if r.name == "" {
+		return true
+	}
+	return os.Remove(r.requestPath) == nil
+}
+
+func (r *Reloader) readChangedAt() {
+	file, err := ioutil.ReadFile(r.changedAtPath)
+	if err != nil {
+		return
+	}
+	os.Remove(r.changedAtPath)
+	changedAt, err := time.Parse(time.RFC3339Nano, string(file))
+	if err != nil {
+		return
+	}
+	r.setChangedAt(changedAt)
+}
+
+// filterChanges drops changed files that are not in the dependency graph of main package if `watch.deps_only` is enabled.
+func (r *Reloader) filterChanges(changes *ChangeSet) *ChangeSet {
+	if r.deps == nil {
+		return changes
+	}
+	filtered := &ChangeSet{Deduplicated: changes.Deduplicated, ChangedAt: changes.ChangedAt}
+	for _, change := range changes.Changes {
+		if isModuleFile(change.Path) {
+			r.deps.invalidate()
+			filtered.Changes = append(filtered.Changes, change)
+			continue
+		}
+		affected, reason, err := r.deps.affects(change.Path)
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+		if !affected {
+			fmt.Printf("Skip: %s\n", reason)
+			continue
+		}
+		filtered.Changes = append(filtered.Changes, change)
+	}
+	return filtered
+}
+
+// Restart restarts the current binary without building.
+func (r *Reloader) Restart() error {
+	if err := r.sendReloadingSignal(); err != nil {
+		return xerrors.Errorf("failed to send reloading signal: %w", err)
+	}
+	return nil
+}
+
+func (r *Reloader) downloadModules() error {
+	if r.build == nil || r.build.ModDownload == "" {
 		return nil
 	}
-	if r.isOnDockerContainer() {
+	fmt.Println("Downloading modules....")
+	switch r.build.ModDownload {
+	case ModDownloadLocal:
+		if err := r.goCommand().ModDownload(); err != nil {
+			return xerrors.Errorf("failed to download modules: %w", err)
+		}
+	case ModDownloadDocker:
+		if !r.isUsedDocker() {
+			return xerrors.New("mod_download: docker requires host.docker")
+		}
+		if err := NewDockerCommand(r.host.Docker, "go", "mod", "download").Run(); err != nil {
+			return xerrors.Errorf("failed to download modules on docker container: %w", err)
+		}
+	default:
+		return xerrors.Errorf("unknown mod_download value %s", r.build.ModDownload)
+	}
+	return nil
+}
+
+func (r *Reloader) runTask(ctx context.Context, name string, changes *ChangeSet) error {
+	task, exists := r.tasks[name]
+	if !exists {
+		return xerrors.Errorf("undefined task %s", name)
+	}
+	env, err := changes.env()
+	if err != nil {
+		return xerrors.Errorf("failed to get env for changed files: %w", err)
+	}
+	for _, cmd := range task.Commands {
+		fmt.Printf("Running: %s\n", cmd)
+		gocmd := NewGoCommand()
+		gocmd.SetContext(ctx)
+		gocmd.AddEnv(env)
+		if err := gocmd.RunInGoContext(strings.Split(cmd, " ")...); err != nil {
+			return xerrors.Errorf("failed to run command %s in task %s: %w", cmd, name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Reloader) Close() error {
+	if !r.isUsedDocker() || r.isOnDockerContainer() {
 		fmt.Println("stop current process...")
 		if err := r.stopCurrentProcess(); err != nil {
 			return xerrors.Errorf("failed to stop current process: %w", err)
 		}
+		if r.listeners != nil {
+			if err := r.listeners.Close(); err != nil {
+				return xerrors.Errorf("failed to close listeners: %w", err)
+			}
+		}
 		return nil
 	}
 
@@ -206,7 +772,7 @@ func (r *Reloader) isOnDockerContainer() bool {
 }
 
 func (r *Reloader) readPID() (int, error) {
-	file, err := ioutil.ReadFile(pidPath)
+	file, err := ioutil.ReadFile(r.pidPath)
 	if err != nil {
 		return -1, xerrors.Errorf("failed to read pid file: %w", err)
 	}
@@ -219,13 +785,22 @@ func (r *Reloader) readPID() (int, error) {
 
 func (r *Reloader) writePID() error {
 	pid := os.Getpid()
-	if err := ioutil.WriteFile(pidPath, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
+	if err := os.MkdirAll(filepath.Dir(r.pidPath), 0755); err != nil {
+		return xerrors.Errorf("failed to create directory for pid file: %w", err)
+	}
+	if err := ioutil.WriteFile(r.pidPath, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
 		return xerrors.Errorf("failed to write pid file: %w", err)
 	}
 	return nil
 }
 
 func (r *Reloader) stopCurrentProcess() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopCurrentProcessLocked()
+}
+
+func (r *Reloader) stopCurrentProcessLocked() error {
 	if r.cmd == nil {
 		return nil
 	}
@@ -237,23 +812,299 @@ func (r *Reloader) stopCurrentProcess() error {
 }
 
 func (r *Reloader) reload() (e error) {
-	fmt.Println("Restarting...")
-	if err := r.stopCurrentProcess(); err != nil {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() {
+		if e != nil {
+			r.notReady(e.Error())
+		}
+	}()
+	fmt.Printf("Restarting%s...\n", r.nameSuffix())
+	r.restartingLocked()
+	r.retries = 0
+	since := r.changedAt
+	if since.IsZero() {
+		since = time.Now()
+	}
+	r.changedAt = time.Time{}
+	if err := r.stopCurrentProcessLocked(); err != nil {
 		return xerrors.Errorf("failed to stop current process: %w", err)
 	}
-	execCmd := NewCommand(buildPath)
+	if err := r.startProcessLocked(since); err != nil {
+		return xerrors.Errorf("failed to start process: %w", err)
+	}
+	return nil
+}
+
+// startProcessLocked starts the new process. since is the beginning of measuring the time to ready.
+func (r *Reloader) startProcessLocked(since time.Time) error {
+	if err := r.waitForPorts(); err != nil {
+		return xerrors.Errorf("failed to wait for ports: %w", err)
+	}
+	execCmd, err := r.newProcessCommand()
+	if err != nil {
+		return xerrors.Errorf("failed to create command: %w", err)
+	}
+	var checks []*ReadyCheck
+	if r.run != nil {
+		checks = r.run.Ready
+	}
+	probe, err := newReadinessProbe(checks)
+	if err != nil {
+		return xerrors.Errorf("failed to parse run.ready: %w", err)
+	}
+	stdout, stderr := r.outputs()
+	if probe.hasLogChecks() {
+		stdout = io.MultiWriter(stdout, probe.logWriter())
+		stderr = io.MultiWriter(stderr, probe.logWriter())
+	}
+	execCmd.SetStdout(stdout)
+	execCmd.SetStderr(stderr)
 	if r.run != nil {
 		env := []string{}
 		for k, v := range r.run.Env {
 			env = append(env, fmt.Sprintf("%s=%s", k, v))
 		}
 		execCmd.AddEnv(env)
+		if r.isDebug() && r.run.StopSignal == "" {
+			// Delve stops the debugger and kills the application by SIGINT.
+			execCmd.SetStopSignal(syscall.SIGINT)
+		}
+		if r.run.StopSignal != "" {
+			sig, err := parseSignal(r.run.StopSignal)
+			if err != nil {
+				return xerrors.Errorf("failed to parse run.stop_signal: %w", err)
+			}
+			execCmd.SetStopSignal(sig)
+		}
+		if r.run.StopTimeout > 0 {
+			execCmd.SetStopTimeout(r.run.StopTimeout.Duration())
+		}
+	}
+	if err := execCmd.RunAsync(); err != nil {
+		return xerrors.Errorf("failed to run %s: %w", r.buildPath, err)
 	}
 	r.cmd = execCmd
-	execCmd.RunAsync()
+	go r.watchExit(execCmd, time.Now())
+	go r.watchReady(execCmd, probe, since)
+	return nil
+}
+
+// nameSuffix returns the process name for progress messages.
+func (r *Reloader) nameSuffix() string {
+	if r.name == "" {
+		return ""
+	}
+	return " " + r.name
+}
+
+// outputs returns writers for stdout and stderr of the process. Each line is prefixed by the process prefix.
+func (r *Reloader) outputs() (io.Writer, io.Writer) {
+	if r.prefix == "" {
+		return os.Stdout, os.Stderr
+	}
+	return newPrefixWriter(os.Stdout, r.prefix), newPrefixWriter(os.Stderr, r.prefix)
+}
+
+// watchReady reports the time to ready and runs `run.after_ready` commands.
+func (r *Reloader) watchReady(cmd *Command, probe *readinessProbe, since time.Time) {
+	if err := probe.wait(cmd.Done()); err != nil {
+		if cmd.IsStopRequested() {
+			return
+		}
+		fmt.Printf("Reload failed%s: %v\n", r.nameSuffix(), err)
+		r.writeReloaded(err)
+		r.notReady(err.Error())
+		return
+	}
+	fmt.Printf("Ready%s: %s\n", r.nameSuffix(), time.Since(since).Round(time.Millisecond))
+	r.writeReloaded(nil)
+	r.ready()
+	if err := r.runAfterReadyCommands(); err != nil {
+		log.Printf("%+v", err)
+	}
+}
+
+func (r *Reloader) runAfterReadyCommands() error {
+	if r.run == nil {
+		return nil
+	}
+	env := []string{}
+	for k, v := range r.run.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	for _, cmd := range r.run.AfterReady {
+		fmt.Printf("Running: %s\n", cmd)
+		execCmd := NewCommand(strings.Split(cmd, " ")...)
+		execCmd.AddEnv(env)
+		if err := execCmd.Run(); err != nil {
+			return xerrors.Errorf("failed to run command %s in run.after_ready: %w", cmd, err)
+		}
+	}
 	return nil
 }
 
+func (r *Reloader) newProcessCommand() (*Command, error) {
+	args := []string{r.buildPath}
+	if r.run != nil {
+		args = append(args, r.run.Args...)
+	}
+	if r.isDebug() {
+		if len(r.run.Listen) > 0 {
+			// LISTEN_PID can't be the pid of the application started by Delve.
+			return nil, xerrors.New("run.debug can't be used with run.listen")
+		}
+		args = debugArgs(r.run.Debug, r.isOnDockerContainer(), r.buildPath, r.run.Args)
+	}
+	var execCmd *Command
+	if r.run == nil || len(r.run.Listen) == 0 {
+		execCmd = NewCommand(args...)
+	} else {
+		if r.listeners == nil {
+			listeners, err := newSocketListeners(r.run.Listen)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to listen run.listen addresses: %w", err)
+			}
+			r.listeners = listeners
+		}
+		execCmd = NewCommand(append([]string{"/bin/sh", "-c", listenPIDScript}, args...)...)
+		execCmd.SetExtraFiles(r.listeners.files)
+		execCmd.AddEnv(r.listeners.env())
+	}
+	if r.run != nil && r.run.Dir != "" {
+		execCmd.SetDir(ExpandPath(r.run.Dir))
+	}
+	if r.isStdinInherited() {
+		// the process in the background process group can't read from the terminal.
+		execCmd.SetStdin(os.Stdin)
+	} else {
+		execCmd.EnableProcessGroup()
+	}
+	return execCmd, nil
+}
+
+func (r *Reloader) isDebug() bool {
+	return r.run != nil && r.run.Debug != nil
+}
+
+func (r *Reloader) isStdinInherited() bool {
+	return r.run != nil && r.run.Stdin
+}
+
+func (r *Reloader) restartPolicy() string {
+	if r.run == nil || r.run.Restart == "" {
+		return RestartNever
+	}
+	return r.run.Restart
+}
+
+func (r *Reloader) maxRetries() int {
+	if r.run == nil || r.run.MaxRetries == nil {
+		return defaultMaxRetries
+	}
+	return *r.run.MaxRetries
+}
+
+func (r *Reloader) restartDelay() time.Duration {
+	if r.run == nil || r.run.RestartDelay == 0 {
+		return defaultRestartDelay
+	}
+	return r.run.RestartDelay.Duration()
+}
+
+// watchExit restarts the process exited by itself according to `run.restart` policy.
+func (r *Reloader) watchExit(cmd *Command, startedAt time.Time) {
+	<-cmd.Done()
+	if cmd.IsStopRequested() {
+		return
+	}
+	state := cmd.ProcessState()
+	fmt.Printf("process exited with %s\n", describeExit(state))
+	switch r.restartPolicy() {
+	case RestartAlways:
+	case RestartOnFailure:
+		if !isFailureExit(state) {
+			return
+		}
+	case RestartNever:
+		return
+	default:
+		log.Printf("unknown run.restart policy %s", r.restartPolicy())
+		return
+	}
+
+	r.mu.Lock()
+	if time.Since(startedAt) >= restartResetDuration {
+		r.retries = 0
+	}
+	if r.retries >= r.maxRetries() {
+		retries := r.retries
+		r.mu.Unlock()
+		fmt.Printf("gave up restarting after %d retries. waiting for next change\n", retries)
+		r.notReady(fmt.Sprintf("process exited with %s", describeExit(state)))
+		return
+	}
+	delay := restartDelay(r.restartDelay(), r.retries)
+	r.retries++
+	retries := r.retries
+	// requests are held during the backoff too.
+	r.restartingLocked()
+	r.mu.Unlock()
+
+	fmt.Printf("Restarting in %s ( retry %d/%d )...\n", delay, retries, r.maxRetries())
+	time.Sleep(delay)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd != cmd {
+		// already reloaded or stopped during backoff.
+		return
+	}
+	r.cmd = nil
+	if err := r.startProcessLocked(time.Now()); err != nil {
+		r.notReady(err.Error())
+		log.Printf("%+v", xerrors.Errorf("failed to restart process: %w", err))
+	}
+}
+
+func (r *Reloader) waitForPorts() error {
+	if r.run == nil || (len(r.run.Ports) == 0 && r.run.Debug == nil) {
+		return nil
+	}
+	timeout := defaultPortTimeout
+	if r.run.PortTimeout > 0 {
+		timeout = r.run.PortTimeout.Duration()
+	}
+	ports := []int{}
+	for _, port := range r.run.Ports {
+		if r.isListeningPort(port) {
+			// the port is kept listening by rebirth for the application.
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if r.isDebug() {
+		// the new debugger listens on the same address.
+		ports = append(ports, r.run.Debug.port())
+	}
+	if err := waitForPorts(ports, timeout); err != nil {
+		return xerrors.Errorf("failed to wait for releasing ports: %w", err)
+	}
+	return nil
+}
+
+func (r *Reloader) isListeningPort(port int) bool {
+	if r.listeners == nil {
+		return false
+	}
+	for _, p := range r.listeners.ports() {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Reloader) watchReloadSignal() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP)
@@ -261,7 +1112,16 @@ func (r *Reloader) watchReloadSignal() {
 	go func() {
 		for {
 			<-sig
-			go r.reload()
+			if !r.isRequestedReload() {
+				continue
+			}
+			r.readChangedAt()
+			go func() {
+				if err := r.reload(); err != nil {
+					r.writeReloaded(err)
+					log.Printf("%+v", err)
+				}
+			}()
 		}
 	}()
 }
@@ -289,11 +1149,8 @@ func (r *Reloader) xbuildRebirth() error {
 	return nil
 }
 
-func (r *Reloader) xbuild(target, source string) error {
-	fmt.Println("Building....")
-	if err := r.runBuildBeforeCommands(); err != nil {
-		return xerrors.Errorf("failed to run build.before commands: %w", err)
-	}
+// goCommand returns GoCommand with the build settings for main package.
+func (r *Reloader) goCommand() *GoCommand {
 	gocmd := NewGoCommand()
 	if r.build != nil {
 		env := []string{}
@@ -301,14 +1158,57 @@ func (r *Reloader) xbuild(target, source string) error {
 			env = append(env, fmt.Sprintf("%s=%s", k, ExpandPath(v)))
 		}
 		gocmd.AddEnv(env)
+		gocmd.AddBuildFlags(r.build.Flags)
+		gocmd.AddTags(r.build.Tags)
+		gocmd.AddLdflags(r.build.Ldflags)
+	}
+	if r.isDebug() {
+		gocmd.AddBuildFlags([]string{debugGCFlags})
 	}
 	if r.isUsedDocker() && !r.isOnDockerContainer() {
 		gocmd.EnableCrossBuild(r.host.Docker)
 	}
-	if err := gocmd.Build("-o", target, source); err != nil {
-		return xerrors.Errorf("failed to build: %w", err)
+	return gocmd
+}
+
+// BuildError is returned when go build or build hooks failed.
+// Output has stderr of the command, and Diagnostics are parsed from it.
+type BuildError struct {
+	Output      string
+	Diagnostics []*Diagnostic
+	Err         error
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+func (r *Reloader) xbuild(ctx context.Context, target, source string, changes *ChangeSet) error {
+	if changes != nil && changes.Deduplicated > 0 {
+		fmt.Printf("Building%s.... ( %d events deduplicated )\n", r.nameSuffix(), changes.Deduplicated)
+	} else {
+		fmt.Printf("Building%s....\n", r.nameSuffix())
+	}
+	if err := r.runBuildBeforeCommands(ctx, changes); err != nil {
+		return xerrors.Errorf("failed to run build.before commands: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return xerrors.Errorf("failed to create directory for %s: %w", target, err)
+	}
+	gocmd := r.goCommand()
+	gocmd.SetContext(ctx)
+	capture := r.diagnostics.Capture()
+	gocmd.SetStderr(capture)
+	err := gocmd.Build("-o", target, source)
+	output, diagnostics := capture.Finish()
+	if err != nil {
+		return xerrors.Errorf("failed to build: %w", &BuildError{Output: output, Diagnostics: diagnostics, Err: err})
 	}
-	if err := r.runBuildAfterCommands(); err != nil {
+	if err := r.runBuildAfterCommands(ctx, changes); err != nil {
 		return xerrors.Errorf("failed to run build.after commands: %w", err)
 	}
 	return nil
@@ -316,13 +1216,9 @@ func (r *Reloader) xbuild(target, source string) error {
 
 func (r *Reloader) sendReloadingSignal() error {
 	if r.host != nil && r.host.Docker != "" {
-		pid, err := r.readPID()
-		if err != nil {
-			return xerrors.Errorf("failed to read pid: %w", err)
-		}
-		containerName := r.host.Docker
-		if err := NewDockerCommand(containerName, "kill", "-HUP", fmt.Sprint(pid)).Run(); err != nil {
-			return xerrors.Errorf("failed to exec command on docker container: %w", err)
+		if err := r.reloadOnContainer(); err != nil {
+			r.notReady(err.Error())
+			return xerrors.Errorf("failed to reload on docker container: %w", err)
 		}
 		return nil
 	}
@@ -331,3 +1227,27 @@ func (r *Reloader) sendReloadingSignal() error {
 	}
 	return nil
 }
+
+// reloadOnContainer sends SIGHUP to rebirth on the docker container.
+func (r *Reloader) reloadOnContainer() error {
+	pid, err := r.readPID()
+	if err != nil {
+		return xerrors.Errorf("failed to read pid: %w", err)
+	}
+	if err := r.writeChangedAt(); err != nil {
+		return xerrors.Errorf("failed to write the time of change: %w", err)
+	}
+	r.restarting()
+	gen := r.nextReloadGen()
+	os.Remove(r.reloadedPath)
+	if err := r.requestReload(); err != nil {
+		return xerrors.Errorf("failed to request reloading: %w", err)
+	}
+	containerName := r.host.Docker
+	if err := NewDockerCommand(containerName, "kill", "-HUP", fmt.Sprint(pid)).Run(); err != nil {
+		return xerrors.Errorf("failed to exec command on docker container: %w", err)
+	}
+	// the previous process may still accept connections until rebirth on the container stops it.
+	r.watchContainerReady(gen)
+	return nil
+}
@@ -0,0 +1,50 @@
+package rebirth
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultMaxRetries   = 5
+	defaultRestartDelay = 1 * time.Second
+	maxRestartDelay     = 30 * time.Second
+
+	// retry count is reset if the process keeps running longer than this.
+	restartResetDuration = 10 * time.Second
+)
+
+// describeExit returns exit code or signal that terminated the process.
+func describeExit(state *os.ProcessState) string {
+	if state == nil {
+		return "unknown status"
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return fmt.Sprintf("signal %s", status.Signal())
+	}
+	return fmt.Sprintf("exit code %d", state.ExitCode())
+}
+
+func isFailureExit(state *os.ProcessState) bool {
+	return state == nil || !state.Success()
+}
+
+// restartDelay returns exponential backoff delay for the retry count.
+func restartDelay(base time.Duration, retries int) time.Duration {
+	delay := base
+	for i := 0; i < retries; i++ {
+		delay *= 2
+		if delay >= maxRestartDelay {
+			return maxRestartDelay
+		}
+	}
+	return delay
+}
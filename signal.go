@@ -0,0 +1,29 @@
+package rebirth
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+var signalMap = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal parses signal name ( e.g. SIGTERM, TERM ) or number.
+func parseSignal(name string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(num), nil
+	}
+	sig, exists := signalMap[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !exists {
+		return 0, xerrors.Errorf("unknown signal %s", name)
+	}
+	return sig, nil
+}
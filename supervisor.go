@@ -0,0 +1,243 @@
+package rebirth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Supervisor manages reloaders of `processes` sharing one Watcher.
+// If `processes` is not defined, it manages the single process of top-level `build` and `run`.
+type Supervisor struct {
+	base        *Reloader
+	reloaders   []*Reloader
+	isProcesses bool
+}
+
+// NewSupervisor creates Supervisor for processes selected by names. All processes are selected if names is empty.
+func NewSupervisor(cfg *Config, names ...string) (*Supervisor, error) {
+	base := NewReloader(cfg)
+	if len(cfg.Processes) == 0 {
+		if len(names) > 0 {
+			return nil, xerrors.New("processes is not defined")
+		}
+		return &Supervisor{base: base, reloaders: []*Reloader{base}}, nil
+	}
+	// each process has its own target, so top-level proxy and live_reload can't be shared by processes.
+	if cfg.Proxy != nil || cfg.LiveReload != nil {
+		return nil, xerrors.New("proxy and live_reload must be defined in each entry of processes instead of top-level")
+	}
+	if len(names) == 0 {
+		for name := range cfg.Processes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	reloaders := make([]*Reloader, 0, len(names))
+	for _, name := range names {
+		process, exists := cfg.Processes[name]
+		if !exists {
+			return nil, xerrors.Errorf("undefined process %s", name)
+		}
+		prefix := process.Prefix
+		if prefix == "" {
+			prefix = fmt.Sprintf("[%s] ", name)
+		}
+		reloaders = append(reloaders, newReloader(name, prefix, processConfig(cfg, process)))
+	}
+	return &Supervisor{base: base, reloaders: reloaders, isProcesses: true}, nil
+}
+
+// processConfig returns config for the process inheriting top-level settings.
+func processConfig(cfg *Config, process *Process) *Config {
+	return &Config{
+		Host:       cfg.Host,
+		Build:      mergeBuild(cfg.Build, process.Build),
+		Run:        mergeRun(cfg.Run, process.Run),
+		Watch:      cfg.Watch,
+		Task:       cfg.Task,
+		Proxy:      process.Proxy,
+		LiveReload: process.LiveReload,
+	}
+}
+
+// mergeBuild overrides top-level build settings by the process.
+// build.init of top-level is called once by Supervisor, so it is not inherited.
+func mergeBuild(base, build *Build) *Build {
+	merged := &Build{}
+	if base != nil {
+		*merged = *base
+		merged.Init = nil
+	}
+	if build == nil {
+		return merged
+	}
+	if build.Main != "" {
+		merged.Main = build.Main
+	}
+	merged.Env = mergeEnv(merged.Env, build.Env)
+	merged.Init = build.Init
+	if len(build.Before) > 0 {
+		merged.Before = build.Before
+	}
+	if len(build.After) > 0 {
+		merged.After = build.After
+	}
+	if build.ModDownload != "" {
+		merged.ModDownload = build.ModDownload
+	}
+	if len(build.Flags) > 0 {
+		merged.Flags = build.Flags
+	}
+	if len(build.Tags) > 0 {
+		merged.Tags = build.Tags
+	}
+	if build.Ldflags != "" {
+		merged.Ldflags = build.Ldflags
+	}
+	if build.History > 0 {
+		merged.History = build.History
+	}
+	if build.Diagnostics != nil {
+		merged.Diagnostics = build.Diagnostics
+	}
+	return merged
+}
+
+// mergeRun uses run settings of the process if it's specified. run.env is merged with top-level.
+func mergeRun(base, run *Run) *Run {
+	if run == nil {
+		return base
+	}
+	merged := *run
+	if base != nil {
+		merged.Env = mergeEnv(base.Env, run.Env)
+	}
+	return &merged
+}
+
+func mergeEnv(base, env map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (s *Supervisor) IsEnabledReload() bool {
+	return s.base.IsEnabledReload()
+}
+
+func (s *Supervisor) Run() error {
+	if s.base.isUsedDocker() && !s.base.isOnDockerContainer() {
+		if err := s.base.xbuildRebirth(); err != nil {
+			return xerrors.Errorf("failed to cross compile for rebirth: %w", err)
+		}
+	}
+	if s.isProcesses && s.IsEnabledReload() {
+		if err := s.base.runBuildInitCommands(); err != nil {
+			return xerrors.Errorf("failed to build.init commands: %w", err)
+		}
+	}
+	for _, r := range s.reloaders {
+		if err := r.start(); err != nil {
+			return xerrors.Errorf("failed to start %s: %w", r.name, err)
+		}
+	}
+	select {}
+}
+
+// Handle runs tasks once and reloads processes affected by changed files.
+func (s *Supervisor) Handle(ctx context.Context, changes *ChangeSet) error {
+	if !s.isProcesses {
+		return s.base.Handle(ctx, changes)
+	}
+	fmt.Printf("Changed: %s\n", changes)
+	plan, err := s.base.rules.plan(changes.Paths())
+	if err != nil {
+		return xerrors.Errorf("failed to decide action: %w", err)
+	}
+	if err := s.base.prepare(ctx, plan, changes); err != nil {
+		return xerrors.Errorf("failed to prepare: %w", err)
+	}
+	var firstErr error
+	for _, r := range s.reloaders {
+		if err := ctx.Err(); err != nil {
+			return xerrors.Errorf("canceled: %w", err)
+		}
+		if err := r.handleProcess(ctx, changes); err != nil {
+			if firstErr != nil {
+				log.Printf("%+v", err)
+				continue
+			}
+			firstErr = xerrors.Errorf("failed to reload %s: %w", r.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (s *Supervisor) Close() error {
+	var firstErr error
+	for _, r := range s.reloaders {
+		if err := r.Close(); err != nil {
+			if firstErr != nil {
+				log.Printf("%+v", err)
+				continue
+			}
+			firstErr = xerrors.Errorf("failed to close %s: %w", r.name, err)
+		}
+	}
+	return firstErr
+}
+
+// Rollback restarts the process by the artifact of the generation. The previous generation is used if generation is zero.
+func (s *Supervisor) Rollback(generation int) error {
+	if len(s.reloaders) > 1 {
+		return xerrors.New("process name is required for rollback")
+	}
+	if err := s.reloaders[0].Rollback(generation); err != nil {
+		return xerrors.Errorf("failed to rollback process: %w", err)
+	}
+	return nil
+}
+
+// prefixWriter writes prefix at the beginning of each line.
+type prefixWriter struct {
+	w           io.Writer
+	prefix      []byte
+	mu          sync.Mutex
+	isLineStart bool
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix), isLineStart: true}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var buf bytes.Buffer
+	for _, b := range p {
+		if w.isLineStart {
+			buf.Write(w.prefix)
+			w.isLineStart = false
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			w.isLineStart = true
+		}
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
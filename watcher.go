@@ -9,112 +9,291 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/xerrors"
 	"gopkg.in/fsnotify.v1"
 )
 
-type state int
+type Watcher struct {
+	// backend is replaced by fallbackToPolling in the goroutine receiving events. mu protects it from Close.
+	backend     watchBackend
+	mu          sync.Mutex
+	eventCh     chan fsnotify.Event
+	callback    func(context.Context, *ChangeSet) error
+	clock       clock
+	done        chan struct{}
+	wg          sync.WaitGroup
+	cfg         *Watch
+	watchedDirs map[string]struct{}
+	include     []*pattern
+	exclude     []*pattern
+	ignore      *ignoreMatcher
+	rules       *actionRules
+	hashes      *contentHashes
+	// lastFailed is true if the last callback failed. It's used by only one callback goroutine at a time.
+	lastFailed bool
+}
 
 const (
-	idleState state = iota
-	busyState
+	defaultRoot  = "."
+	defaultDelay = 500 * time.Millisecond
 )
 
-type Watcher struct {
-	goWatcher  *fsnotify.Watcher
-	eventCh    chan struct{}
-	callback   func()
-	watchState state
-	mu         sync.Mutex
-	cfg        *Watch
+var (
+	defaultIncludePatterns = []string{"*.go"}
+	defaultExcludePatterns = []string{"*_test.go", ".*", "#*"}
+)
+
+// NewWatcher creates Watcher by `watch` config. It returns error if the config has malformed patterns.
+// `exclude` is added to the default patterns, so that hidden files and lock files of editors ( e.g. `.#main.go` ) never trigger rebuild.
+func NewWatcher(cfg *Config) (*Watcher, error) {
+	include := defaultIncludePatterns
+	exclude := defaultExcludePatterns
+	ignore := []string{}
+	if cfg.Watch != nil {
+		ignore = cfg.Watch.Ignore
+		if len(cfg.Watch.Include) > 0 {
+			include = cfg.Watch.Include
+		}
+		exclude = append(append([]string{}, defaultExcludePatterns...), cfg.Watch.Exclude...)
+	}
+	w := &Watcher{
+		eventCh:     make(chan fsnotify.Event, 128),
+		clock:       realClock{},
+		done:        make(chan struct{}),
+		cfg:         cfg.Watch,
+		watchedDirs: map[string]struct{}{},
+		include:     newPatterns(include),
+		exclude:     newPatterns(exclude),
+		ignore:      newIgnoreMatcher(ignore),
+		rules:       newActionRules(cfg.Watch),
+		hashes:      newContentHashes(),
+	}
+	if err := validatePatterns(w.include); err != nil {
+		return nil, xerrors.Errorf("invalid watch.include: %w", err)
+	}
+	if err := validatePatterns(w.exclude); err != nil {
+		return nil, xerrors.Errorf("invalid watch.exclude: %w", err)
+	}
+	if err := w.ignore.validate(); err != nil {
+		return nil, xerrors.Errorf("invalid watch.ignore: %w", err)
+	}
+	if err := w.rules.validate(); err != nil {
+		return nil, xerrors.Errorf("invalid watch.rules: %w", err)
+	}
+	return w, nil
 }
 
-const (
-	defaultRoot = "."
-)
+func (w *Watcher) isTargetFile(path string) bool {
+	relPath := w.relPath(path)
+	if !matchAny(w.include, relPath) {
+		return false
+	}
+	if matchAny(w.exclude, relPath) {
+		return false
+	}
+	if w.ignore.match(relPath, false) {
+		return false
+	}
+	return true
+}
 
-func NewWatcher(cfg *Config) *Watcher {
-	return &Watcher{
-		eventCh:    make(chan struct{}, 1),
-		watchState: idleState,
-		cfg:        cfg.Watch,
+func (w *Watcher) isRuleTargetFile(path string) bool {
+	relPath := w.relPath(path)
+	if !w.rules.match(relPath) {
+		return false
+	}
+	if matchAny(w.exclude, relPath) {
+		return false
+	}
+	if w.ignore.match(relPath, false) {
+		return false
 	}
+	return true
 }
 
-func (w *Watcher) addEvent(event fsnotify.Event) {
-	name := filepath.Base(event.Name)
-	if strings.HasPrefix(name, "#") {
-		return
+func (w *Watcher) isWatchedFile(path string) bool {
+	if isModuleFile(path) {
+		return true
 	}
-	if strings.HasPrefix(name, ".") {
-		return
+	if w.isOutsideRoot(path) {
+		// the current directory is watched only for module files.
+		return false
 	}
-	if filepath.Ext(name) != ".go" {
+	return w.isTargetFile(path) || w.isRuleTargetFile(path)
+}
+
+func (w *Watcher) addEvent(event fsnotify.Event) {
+	if !w.isWatchedFile(event.Name) {
 		return
 	}
-	if strings.HasSuffix(name, "_test.go") {
-		return
+	w.notify(event)
+}
+
+func (w *Watcher) notify(event fsnotify.Event) {
+	select {
+	case w.eventCh <- event:
+	case <-w.done:
 	}
+}
 
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.watchState = busyState
-	w.eventCh <- struct{}{}
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	if filepath.Base(event.Name) == gitignoreFile {
+		dir := filepath.Dir(event.Name)
+		w.ignore.loadGitignore(w.root(), filepath.ToSlash(w.relPath(dir)))
+		w.syncIgnoredDirs(dir)
+	}
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			w.addDir(event.Name)
+			return
+		}
+		w.addEvent(event)
+	case event.Op&fsnotify.Write == fsnotify.Write:
+		w.addEvent(event)
+	case event.Op&fsnotify.Remove == fsnotify.Remove, event.Op&fsnotify.Rename == fsnotify.Rename:
+		if _, exists := w.watchedDirs[event.Name]; exists {
+			w.removeDir(event.Name)
+			w.notify(event)
+			return
+		}
+		w.addEvent(event)
+	}
 }
 
-func (w *Watcher) root() string {
-	if w.cfg == nil {
-		return defaultRoot
+// addDir starts watching the directory created after starting watcher and its sub directories.
+// Files already put in them are handled as created files because they have no events.
+func (w *Watcher) addDir(dir string) {
+	for _, path := range w.walkDirs(dir) {
+		if _, exists := w.watchedDirs[path]; exists {
+			continue
+		}
+		fmt.Printf("Watching %s\n", path)
+		if err := w.backend.Add(path); err != nil {
+			_, isPolling := w.backend.(*pollBackend)
+			if isPolling || !xerrors.Is(err, syscall.ENOSPC) {
+				log.Printf("%+v", xerrors.Errorf("failed to add path %s: %w", path, err))
+				continue
+			}
+			// reached the limit of inotify watches ( fs.inotify.max_user_watches ) by the new directory.
+			fmt.Printf("%s\nfallback to polling mode\n", err)
+			if err := w.fallbackToPolling(); err != nil {
+				log.Printf("%+v", xerrors.Errorf("failed to fallback to polling mode: %w", err))
+				return
+			}
+			if err := w.backend.Add(path); err != nil {
+				log.Printf("%+v", xerrors.Errorf("failed to add path %s: %w", path, err))
+				continue
+			}
+		}
+		w.watchedDirs[path] = struct{}{}
+		matches, _ := filepath.Glob(filepath.Join(path, "*"))
+		for _, match := range matches {
+			w.addEvent(fsnotify.Event{Name: match, Op: fsnotify.Create})
+		}
 	}
-	root := w.cfg.Root
-	if root == "" {
-		return defaultRoot
+}
+
+// removeDir stops watching the removed directory and its sub directories.
+func (w *Watcher) removeDir(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for path := range w.watchedDirs {
+		if path != dir && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		fmt.Printf("Unwatching %s\n", path)
+		// the watch for removed directory is already deleted by the kernel, so ignore error.
+		_ = w.backend.Remove(path)
+		delete(w.watchedDirs, path)
 	}
-	return root
 }
 
-func (w *Watcher) ignorePaths() []string {
-	root := w.root()
+// syncIgnoredDirs applies the changed .gitignore in dir to watched directories under it.
+// Directories ignored by the new rules are unwatched, and directories no longer ignored are watched.
+func (w *Watcher) syncIgnoredDirs(dir string) {
+	prefix := dir + string(filepath.Separator)
 	paths := []string{}
-	if w.cfg == nil {
-		return paths
-	}
-	for _, path := range w.cfg.Ignore {
-		if defaultRoot != "." {
-			paths = append(paths, filepath.Join(root, path))
-		} else {
+	for path := range w.watchedDirs {
+		if dir == "." || strings.HasPrefix(path, prefix) {
 			paths = append(paths, path)
 		}
 	}
-	return paths
+	// parent directories are checked first, and their sub directories are unwatched together.
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, exists := w.watchedDirs[path]; !exists {
+			continue
+		}
+		if w.isIgnoredDir(path) {
+			w.removeDir(path)
+		}
+	}
+	w.addDir(dir)
 }
 
-func (w *Watcher) watchPaths() []string {
-	ignorePaths := w.ignorePaths()
-	pathMap := map[string]struct{}{}
-	filepath.Walk(w.root(), func(path string, info os.FileInfo, err error) error {
+func watchRoot(cfg *Watch) string {
+	if cfg == nil || cfg.Root == "" {
+		return defaultRoot
+	}
+	return cfg.Root
+}
+
+func (w *Watcher) root() string {
+	return watchRoot(w.cfg)
+}
+
+func (w *Watcher) relPath(path string) string {
+	relPath, err := filepath.Rel(w.root(), path)
+	if err != nil {
+		return path
+	}
+	return relPath
+}
+
+func (w *Watcher) isIgnoredDir(path string) bool {
+	relPath := w.relPath(path)
+	if relPath == "." {
+		return false
+	}
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return true
+	}
+	return w.ignore.match(relPath, true)
+}
+
+// walkDirs returns directories under root except ignored directories and loads .gitignore in them.
+func (w *Watcher) walkDirs(root string) []string {
+	paths := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info == nil {
 			return nil
 		}
 		if !info.IsDir() {
 			return nil
 		}
-		if strings.HasPrefix(path, ".") {
-			return nil
+		if w.isIgnoredDir(path) {
+			return filepath.SkipDir
 		}
-		for _, p := range ignorePaths {
-			if strings.HasPrefix(path, p) {
-				return nil
-			}
-		}
-		pathMap[path] = struct{}{}
+		w.ignore.loadGitignore(w.root(), filepath.ToSlash(w.relPath(path)))
+		paths = append(paths, path)
 		return nil
 	})
-	paths := []string{w.root()}
-	for path := range pathMap {
-		paths = append(paths, path)
+	return paths
+}
+
+func (w *Watcher) isOutsideRoot(path string) bool {
+	relPath := w.relPath(path)
+	return relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+func (w *Watcher) watchPaths() []string {
+	paths := w.walkDirs(w.root())
+	if w.isOutsideRoot(defaultRoot) {
+		// watch go.mod and go.sum in the current directory.
+		paths = append(paths, defaultRoot)
 	}
 	sort.Strings(paths)
 	return paths
@@ -129,17 +308,25 @@ func (w *Watcher) fileNumForWatching(paths []string) int {
 	return fileNum
 }
 
-func (w *Watcher) Run(callback func()) error {
-	w.callback = callback
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return xerrors.Errorf("failed to create fsnotify instance: %w", err)
+func (w *Watcher) mode() string {
+	if w.cfg == nil || w.cfg.Mode == "" {
+		return WatchModeNotify
 	}
-	watchPaths := w.watchPaths()
+	return w.cfg.Mode
+}
+
+func (w *Watcher) pollInterval() time.Duration {
+	if w.cfg == nil {
+		return defaultPollInterval
+	}
+	return w.cfg.Interval.Duration()
+}
+
+func (w *Watcher) addWatchPaths(backend watchBackend, watchPaths []string) error {
 	fileNum := w.fileNumForWatching(watchPaths)
 	for _, path := range watchPaths {
 		fmt.Printf("Watching %s\n", path)
-		if err := watcher.Add(path); err != nil {
+		if err := backend.Add(path); err != nil {
 			return xerrors.Errorf(
 				"failed to add path %s. current total watching file number is %d: %w",
 				path,
@@ -147,58 +334,270 @@ func (w *Watcher) Run(callback func()) error {
 				err,
 			)
 		}
+		w.watchedDirs[path] = struct{}{}
 	}
-	go func() {
-		defer w.recoverRuntimeError()
-		for {
-			select {
-			case event := <-watcher.Events:
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					w.addEvent(event)
-				} else if event.Op&fsnotify.Write == fsnotify.Write {
-					w.addEvent(event)
-				} else if event.Op&fsnotify.Write == fsnotify.Remove {
-					w.addEvent(event)
-				} else if event.Op&fsnotify.Write == fsnotify.Rename {
-					w.addEvent(event)
-				}
-			case err := <-watcher.Errors:
-				log.Printf("%+v", err)
-			}
+	return nil
+}
+
+func (w *Watcher) newBackend(watchPaths []string) (watchBackend, error) {
+	switch w.mode() {
+	case WatchModePoll:
+		backend := newPollBackend(w.pollInterval())
+		if err := w.addWatchPaths(backend, watchPaths); err != nil {
+			return nil, xerrors.Errorf("failed to add watch paths: %w", err)
+		}
+		return backend, nil
+	case WatchModeNotify:
+	default:
+		return nil, xerrors.Errorf("unknown watch mode %s", w.mode())
+	}
+	backend, err := newNotifyBackend()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create fsnotify instance: %w", err)
+	}
+	if err := w.addWatchPaths(backend, watchPaths); err != nil {
+		backend.Close()
+		if !xerrors.Is(err, syscall.ENOSPC) {
+			return nil, xerrors.Errorf("failed to add watch paths: %w", err)
+		}
+		// reached the limit of inotify watches ( fs.inotify.max_user_watches ).
+		fmt.Printf("%s\nfallback to polling mode\n", err)
+		w.watchedDirs = map[string]struct{}{}
+		pollBackend := newPollBackend(w.pollInterval())
+		if err := w.addWatchPaths(pollBackend, watchPaths); err != nil {
+			return nil, xerrors.Errorf("failed to add watch paths: %w", err)
+		}
+		return pollBackend, nil
+	}
+	return backend, nil
+}
+
+// fallbackToPolling replaces the backend by the poll backend watching the same directories.
+// It must be called by the goroutine receiving events, so that it receives events from the new backend.
+func (w *Watcher) fallbackToPolling() error {
+	paths := make([]string, 0, len(w.watchedDirs))
+	for path := range w.watchedDirs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	backend := newPollBackend(w.pollInterval())
+	for _, path := range paths {
+		if err := backend.Add(path); err != nil {
+			// removed while watching.
+			delete(w.watchedDirs, path)
 		}
-	}()
-	w.goWatcher = watcher
-
-	go func() {
-		for {
-			switch w.watchState {
-			case idleState:
-				time.Sleep(10 * time.Millisecond)
-			case busyState:
-				func() {
-					ctx, cancel := context.WithTimeout(context.Background(), 2000*time.Millisecond)
-					defer cancel()
-					select {
-					case <-w.eventCh:
-						// receive event. continue busy phase
-					case <-ctx.Done():
-						// end busy phase.
-						w.mu.Lock()
-						defer w.mu.Unlock()
-						w.callback()
-						if len(w.eventCh) > 0 {
-							// exists event. receive it for escaping blocking
-							<-w.eventCh
-						}
-						w.watchState = idleState
-					}
-				}()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		backend.Close()
+		return xerrors.New("watcher is already closed")
+	default:
+	}
+	prev := w.backend
+	w.backend = backend
+	if err := prev.Close(); err != nil {
+		log.Printf("%+v", xerrors.Errorf("failed to close previous backend: %w", err))
+	}
+	return nil
+}
+
+func (w *Watcher) delay() time.Duration {
+	if w.cfg == nil || w.cfg.Delay == 0 {
+		return defaultDelay
+	}
+	return w.cfg.Delay.Duration()
+}
+
+func (w *Watcher) maxWait() time.Duration {
+	if w.cfg == nil {
+		return 0
+	}
+	return w.cfg.MaxWait.Duration()
+}
+
+// quietPeriod returns the duration to wait for next event.
+// It is shortened so that the callback is called within max_wait from the first event.
+func (w *Watcher) quietPeriod(first, now time.Time) time.Duration {
+	delay := w.delay()
+	maxWait := w.maxWait()
+	if maxWait <= 0 {
+		return delay
+	}
+	remaining := first.Add(maxWait).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	if remaining < delay {
+		return remaining
+	}
+	return delay
+}
+
+// Run starts watching. callback is called with changed files after the quiet period.
+// The context passed to callback is canceled when the next batch of changes is ready during the callback.
+func (w *Watcher) Run(callback func(context.Context, *ChangeSet) error) error {
+	w.callback = callback
+	watchPaths := w.watchPaths()
+	backend, err := w.newBackend(watchPaths)
+	if err != nil {
+		return xerrors.Errorf("failed to create watcher: %w", err)
+	}
+	for _, path := range watchPaths {
+		matches, _ := filepath.Glob(filepath.Join(path, "*"))
+		for _, match := range matches {
+			if w.isWatchedFile(match) {
+				w.hashes.add(match)
 			}
 		}
-	}()
+	}
+	w.backend = backend
+	w.wg.Add(2)
+	go w.receiveEvents()
+	go w.debounce()
+	return nil
+}
+
+// Close stops watching and waits for running callback.
+func (w *Watcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	w.mu.Lock()
+	close(w.done)
+	var err error
+	if w.backend != nil {
+		err = w.backend.Close()
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	if err != nil {
+		return xerrors.Errorf("failed to close watcher: %w", err)
+	}
 	return nil
 }
 
+func (w *Watcher) receiveEvents() {
+	defer w.wg.Done()
+	defer w.recoverRuntimeError()
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.backend.Events():
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+		case err, ok := <-w.backend.Errors():
+			if !ok {
+				return
+			}
+			log.Printf("%+v", err)
+		}
+	}
+}
+
+// debounce calls callback after no event is received during delay.
+// If the next batch is ready while running callback, the running callback is canceled
+// and the next batch includes changes of the canceled batch.
+func (w *Watcher) debounce() {
+	defer w.wg.Done()
+	var (
+		pending      bool
+		ready        bool
+		first        time.Time
+		timeout      <-chan time.Time
+		finished     chan struct{}
+		cancel       context.CancelFunc
+		running      map[string]fsnotify.Op
+		runningFirst time.Time
+		changed      = map[string]fsnotify.Op{}
+	)
+	for {
+		select {
+		case <-w.done:
+			// stop the running build instead of waiting for it to finish.
+			if cancel != nil {
+				cancel()
+			}
+			if finished != nil {
+				<-finished
+			}
+			return
+		case event := <-w.eventCh:
+			changed[event.Name] |= event.Op
+			now := w.clock.Now()
+			if !pending {
+				pending = true
+				first = now
+			}
+			ready = false
+			timeout = w.clock.After(w.quietPeriod(first, now))
+			continue
+		case <-timeout:
+			timeout = nil
+			ready = true
+			if finished != nil && cancel != nil {
+				fmt.Println("Canceling: newer changes arrived")
+				cancel()
+				cancel = nil
+				for path, op := range running {
+					changed[path] |= op
+				}
+				if runningFirst.Before(first) {
+					first = runningFirst
+				}
+			}
+		case <-finished:
+			finished = nil
+			cancel = nil
+		}
+		if !ready || finished != nil {
+			continue
+		}
+		changes := newChangeSet(changed)
+		changes.ChangedAt = first
+		running = changed
+		runningFirst = first
+		pending = false
+		ready = false
+		changed = map[string]fsnotify.Op{}
+		finished = make(chan struct{})
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go func(ctx context.Context, cancel context.CancelFunc, finished chan struct{}) {
+			defer close(finished)
+			defer cancel()
+			defer w.recoverRuntimeError()
+			w.runCallback(ctx, changes)
+		}(ctx, cancel, finished)
+	}
+}
+
+// runCallback calls callback with changes whose content is changed since the last successful build.
+func (w *Watcher) runCallback(ctx context.Context, changes *ChangeSet) {
+	changes, pending := w.hashes.dedupe(changes, w.lastFailed)
+	if len(changes.Changes) == 0 {
+		fmt.Printf("Skip: content is not changed ( %d events deduplicated )\n", changes.Deduplicated)
+		return
+	}
+	if err := w.callback(ctx, changes); err != nil {
+		if ctx.Err() != nil {
+			fmt.Println("Canceled: restart with the latest changes")
+			return
+		}
+		w.lastFailed = true
+		fmt.Println(err)
+		return
+	}
+	w.lastFailed = false
+	w.hashes.commit(pending)
+}
+
 func (w *Watcher) recoverRuntimeError() {
 	if err := recover(); err != nil {
 		log.Printf("%+v", err)
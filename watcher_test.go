@@ -0,0 +1,469 @@
+package rebirth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/fsnotify.v1"
+)
+
+// fakeClock fires timers only when Advance is called.
+// Durations passed to After are sent to calls, so tests can wait for debounce to set the timer.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	calls  chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		calls: make(chan time.Duration, 64),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	timer := &fakeTimer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	c.mu.Unlock()
+	c.calls <- d
+	return timer.ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = timers
+}
+
+func newTestWatcher(t *testing.T, cfg *Config) *Watcher {
+	t.Helper()
+	w, err := NewWatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+type watcherTest struct {
+	t       *testing.T
+	dir     string
+	clock   *fakeClock
+	watcher *Watcher
+	calls   chan *ChangeSet
+}
+
+func newWatcherTest(t *testing.T, cfg *Watch, callback func(context.Context, *ChangeSet) error) *watcherTest {
+	dir, err := ioutil.TempDir("", "rebirth-watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt := &watcherTest{
+		t:       t,
+		dir:     dir,
+		clock:   newFakeClock(),
+		watcher: newTestWatcher(t, &Config{Watch: cfg}),
+		calls:   make(chan *ChangeSet, 8),
+	}
+	wt.watcher.clock = wt.clock
+	wt.watcher.callback = func(ctx context.Context, changes *ChangeSet) error {
+		wt.calls <- changes
+		if callback == nil {
+			return nil
+		}
+		return callback(ctx, changes)
+	}
+	wt.watcher.wg.Add(1)
+	go wt.watcher.debounce()
+	return wt
+}
+
+func (wt *watcherTest) close() {
+	close(wt.watcher.done)
+	wt.watcher.wg.Wait()
+	os.RemoveAll(wt.dir)
+}
+
+// write changes the file and sends the event, then waits for the quiet period to be set.
+func (wt *watcherTest) write(name string, quietPeriod time.Duration) string {
+	wt.t.Helper()
+	path := filepath.Join(wt.dir, name)
+	if err := ioutil.WriteFile(path, []byte(name+time.Now().String()), 0644); err != nil {
+		wt.t.Fatal(err)
+	}
+	wt.watcher.eventCh <- fsnotify.Event{Name: path, Op: fsnotify.Write}
+	select {
+	case d := <-wt.clock.calls:
+		if d != quietPeriod {
+			wt.t.Fatalf("unexpected quiet period: expected %s but got %s", quietPeriod, d)
+		}
+	case <-time.After(time.Second):
+		wt.t.Fatal("timer is not set")
+	}
+	return path
+}
+
+func (wt *watcherTest) expectCall() *ChangeSet {
+	wt.t.Helper()
+	select {
+	case changes := <-wt.calls:
+		return changes
+	case <-time.After(time.Second):
+		wt.t.Fatal("callback is not called")
+	}
+	return nil
+}
+
+func (wt *watcherTest) expectNoCall() {
+	wt.t.Helper()
+	select {
+	case changes := <-wt.calls:
+		wt.t.Fatalf("unexpected callback with %s", changes)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewWatcherPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Watch
+		isValid bool
+	}{
+		{name: "default", cfg: nil, isValid: true},
+		{name: "valid patterns", cfg: &Watch{Include: []string{"*.go", "templates/**/*.html"}, Exclude: []string{"mock_*.go"}}, isValid: true},
+		{name: "malformed include", cfg: &Watch{Include: []string{"[*.go"}}},
+		{name: "malformed exclude", cfg: &Watch{Exclude: []string{"gen/[a-/*.go"}}},
+		{name: "malformed ignore", cfg: &Watch{Ignore: []string{"!vendor/["}}},
+		{name: "malformed rule", cfg: &Watch{Rules: []*Rule{{Pattern: "static/**/[", Action: ActionIgnore}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewWatcher(&Config{Watch: test.cfg})
+			if test.isValid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.isValid && err == nil {
+				t.Fatal("malformed pattern should be reported")
+			}
+		})
+	}
+}
+
+func TestWatcherExcludeKeepsDefaults(t *testing.T) {
+	w := newTestWatcher(t, &Config{Watch: &Watch{Exclude: []string{"mock_*.go"}}})
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "main.go", expected: true},
+		{path: "mock_api.go", expected: false},
+		{path: ".#main.go", expected: false},
+		{path: "#main.go#", expected: false},
+		{path: "main_test.go", expected: false},
+	}
+	for _, test := range tests {
+		if w.isTargetFile(test.path) != test.expected {
+			t.Fatalf("unexpected result for %s: expected %v", test.path, test.expected)
+		}
+	}
+}
+
+func TestWatcherDebounceDelay(t *testing.T) {
+	wt := newWatcherTest(t, &Watch{Delay: Duration(500 * time.Millisecond)}, nil)
+	defer wt.close()
+
+	start := wt.clock.Now()
+	a := wt.write("a.go", 500*time.Millisecond)
+	wt.clock.Advance(300 * time.Millisecond)
+	b := wt.write("b.go", 500*time.Millisecond)
+
+	// the quiet period is restarted by the second event.
+	wt.clock.Advance(300 * time.Millisecond)
+	wt.expectNoCall()
+	wt.clock.Advance(200 * time.Millisecond)
+	changes := wt.expectCall()
+	if !reflect.DeepEqual(changes.Paths(), []string{a, b}) {
+		t.Fatalf("unexpected changes: %v", changes.Paths())
+	}
+	if !changes.ChangedAt.Equal(start) {
+		t.Fatalf("ChangedAt should be the time of the first event: expected %s but got %s", start, changes.ChangedAt)
+	}
+}
+
+func TestWatcherDebounceMaxWait(t *testing.T) {
+	wt := newWatcherTest(t, &Watch{
+		Delay:   Duration(500 * time.Millisecond),
+		MaxWait: Duration(time.Second),
+	}, nil)
+	defer wt.close()
+
+	a := wt.write("a.go", 500*time.Millisecond)
+	wt.clock.Advance(400 * time.Millisecond)
+	b := wt.write("b.go", 500*time.Millisecond)
+	wt.clock.Advance(400 * time.Millisecond)
+	// the quiet period is shortened to call the callback within max_wait from the first event.
+	c := wt.write("c.go", 200*time.Millisecond)
+	wt.clock.Advance(200 * time.Millisecond)
+	changes := wt.expectCall()
+	if !reflect.DeepEqual(changes.Paths(), []string{a, b, c}) {
+		t.Fatalf("unexpected changes: %v", changes.Paths())
+	}
+}
+
+func TestWatcherCancelAndMerge(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		canceled int
+	)
+	wt := newWatcherTest(t, &Watch{Delay: Duration(500 * time.Millisecond)}, func(ctx context.Context, changes *ChangeSet) error {
+		if len(changes.Changes) > 1 {
+			return nil
+		}
+		// the first batch keeps running until it's canceled.
+		<-ctx.Done()
+		mu.Lock()
+		canceled++
+		mu.Unlock()
+		return ctx.Err()
+	})
+	defer wt.close()
+
+	start := wt.clock.Now()
+	a := wt.write("a.go", 500*time.Millisecond)
+	wt.clock.Advance(500 * time.Millisecond)
+	first := wt.expectCall()
+	if !reflect.DeepEqual(first.Paths(), []string{a}) {
+		t.Fatalf("unexpected changes: %v", first.Paths())
+	}
+
+	wt.clock.Advance(time.Second)
+	b := wt.write("b.go", 500*time.Millisecond)
+	wt.clock.Advance(500 * time.Millisecond)
+	second := wt.expectCall()
+	if !reflect.DeepEqual(second.Paths(), []string{a, b}) {
+		t.Fatalf("changes of canceled batch should be merged: %v", second.Paths())
+	}
+	if !second.ChangedAt.Equal(start) {
+		t.Fatalf("ChangedAt should be the time of the first event of canceled batch: expected %s but got %s", start, second.ChangedAt)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if canceled != 1 {
+		t.Fatalf("the first callback should be canceled once: %d", canceled)
+	}
+}
+
+func TestWatcherCloseCancelsRunningCallback(t *testing.T) {
+	started := make(chan struct{})
+	wt := newWatcherTest(t, &Watch{Delay: Duration(500 * time.Millisecond)}, func(ctx context.Context, changes *ChangeSet) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer os.RemoveAll(wt.dir)
+
+	wt.write("a.go", 500*time.Millisecond)
+	wt.clock.Advance(500 * time.Millisecond)
+	wt.expectCall()
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		close(wt.watcher.done)
+		wt.watcher.wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("running callback should be canceled by closing watcher")
+	}
+}
+
+type fakeBackend struct {
+	paths map[string]struct{}
+	// limit is the max number of watching paths like fs.inotify.max_user_watches. zero is unlimited.
+	limit  int
+	closed bool
+}
+
+func (b *fakeBackend) Add(path string) error {
+	if b.limit > 0 && len(b.paths) >= b.limit {
+		return syscall.ENOSPC
+	}
+	b.paths[path] = struct{}{}
+	return nil
+}
+
+func (b *fakeBackend) Remove(path string) error {
+	delete(b.paths, path)
+	return nil
+}
+
+func (b *fakeBackend) Events() <-chan fsnotify.Event { return nil }
+func (b *fakeBackend) Errors() <-chan error          { return nil }
+func (b *fakeBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestWatcherGitignoreChange(t *testing.T) {
+	root, err := ioutil.TempDir("", "rebirth-gitignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	gen := filepath.Join(root, "gen")
+	for _, dir := range []string{gen, filepath.Join(gen, "sub"), filepath.Join(root, "src")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := newTestWatcher(t, &Config{Watch: &Watch{Root: root}})
+	backend := &fakeBackend{paths: map[string]struct{}{}}
+	w.backend = backend
+	if err := w.addWatchPaths(backend, w.watchPaths()); err != nil {
+		t.Fatal(err)
+	}
+	isWatched := func(path string) bool {
+		_, watched := w.watchedDirs[path]
+		_, added := backend.paths[path]
+		return watched && added
+	}
+	if !isWatched(gen) || !isWatched(filepath.Join(gen, "sub")) {
+		t.Fatal("gen should be watched before ignored")
+	}
+
+	gitignore := filepath.Join(root, gitignoreFile)
+	if err := ioutil.WriteFile(gitignore, []byte("gen/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.handleEvent(fsnotify.Event{Name: gitignore, Op: fsnotify.Create})
+	if isWatched(gen) || isWatched(filepath.Join(gen, "sub")) {
+		t.Fatal("ignored directories should be unwatched")
+	}
+	if !isWatched(filepath.Join(root, "src")) {
+		t.Fatal("src should be kept watching")
+	}
+
+	if err := os.Remove(gitignore); err != nil {
+		t.Fatal(err)
+	}
+	w.handleEvent(fsnotify.Event{Name: gitignore, Op: fsnotify.Remove})
+	if !isWatched(gen) || !isWatched(filepath.Join(gen, "sub")) {
+		t.Fatal("directories no longer ignored should be watched")
+	}
+}
+
+func TestWatcherFallbackToPollingForNewDirectory(t *testing.T) {
+	root, err := ioutil.TempDir("", "rebirth-fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	w := newTestWatcher(t, &Config{Watch: &Watch{Root: root}})
+	backend := &fakeBackend{paths: map[string]struct{}{}, limit: 1}
+	w.backend = backend
+	if err := w.addWatchPaths(backend, w.watchPaths()); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(root, "pkg")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w.handleEvent(fsnotify.Event{Name: dir, Op: fsnotify.Create})
+	poll, ok := w.backend.(*pollBackend)
+	if !ok {
+		t.Fatalf("backend should be replaced by poll backend: %T", w.backend)
+	}
+	defer poll.Close()
+	if !backend.closed {
+		t.Fatal("previous backend should be closed")
+	}
+	for _, path := range []string{root, dir} {
+		if _, watched := w.watchedDirs[path]; !watched {
+			t.Fatalf("%s should be watched", path)
+		}
+		if _, polled := poll.dirs[path]; !polled {
+			t.Fatalf("%s should be polled", path)
+		}
+	}
+}
+
+func TestWatcherRevertAfterFailedBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebirth-revert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(path, []byte("good"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWatcher(t, &Config{})
+	w.hashes.add(path)
+	calls := 0
+	w.callback = func(ctx context.Context, changes *ChangeSet) error {
+		calls++
+		content, _ := ioutil.ReadFile(path)
+		if string(content) == "broken" {
+			return xerrors.New("failed to build")
+		}
+		return nil
+	}
+	change := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w.runCallback(context.Background(), newChangeSet(map[string]fsnotify.Op{path: fsnotify.Write}))
+	}
+
+	change("broken")
+	if calls != 1 {
+		t.Fatalf("callback should be called for broken content: %d", calls)
+	}
+	// reverted to the content of the last successful build.
+	change("good")
+	if calls != 2 {
+		t.Fatalf("callback should be called after failed build even if content is same as last successful build: %d", calls)
+	}
+	change("good")
+	if calls != 2 {
+		t.Fatalf("unchanged content should be skipped after successful build: %d", calls)
+	}
+}